@@ -40,6 +40,7 @@ func ProcessData(input *os.File, output *os.File) error {
 		}
 	}
 	if handler != nil {
+		handler.shutdown()
 		os.RemoveAll(handler.tempdir)
 	}
 	if err := scanner.Err(); err != nil {
@@ -0,0 +1,111 @@
+package adapter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// cacheQueue adds objects to the cache in the background, such that Git LFS
+// does not have to wait for the cache before a transfer is completed.
+type cacheQueue struct {
+	closed  bool
+	mutex   sync.Mutex
+	pending []*cacheUpload
+	running int
+	signal  *sync.Cond
+	workers sync.WaitGroup
+	upload  func(upload *cacheUpload)
+}
+
+// cacheUpload is an object waiting to be added to the cache. If temporary is
+// set, path is removed once the object was handled.
+type cacheUpload struct {
+	oid       string
+	path      string
+	size      int64
+	temporary bool
+}
+
+func newCacheQueue(workers int, upload func(upload *cacheUpload)) *cacheQueue {
+	q := &cacheQueue{
+		upload: upload,
+	}
+	q.signal = sync.NewCond(&q.mutex)
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go q.worker()
+	}
+	return q
+}
+
+// Add queues an object to be added to the cache.
+func (q *cacheQueue) Add(upload *cacheUpload) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending = append(q.pending, upload)
+	q.signal.Signal()
+}
+
+// Drain stops accepting new objects and waits for the queued objects to be
+// added to the cache, for at most the given timeout. It returns the number of
+// objects that were not added to the cache before the timeout passed. Uploads
+// that are already running are not interrupted.
+func (q *cacheQueue) Drain(timeout time.Duration) int {
+	q.mutex.Lock()
+	q.closed = true
+	q.signal.Broadcast()
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	abandoned := q.pending
+	q.pending = nil
+	for _, upload := range abandoned {
+		if upload.temporary {
+			os.Remove(upload.path)
+		}
+	}
+	return len(abandoned) + q.running
+}
+
+func (q *cacheQueue) worker() {
+	defer q.workers.Done()
+	for {
+		q.mutex.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.signal.Wait()
+		}
+		if len(q.pending) == 0 {
+			q.mutex.Unlock()
+			return
+		}
+		upload := q.pending[0]
+		q.pending = q.pending[1:]
+		q.running++
+		q.mutex.Unlock()
+
+		q.upload(upload)
+		if upload.temporary {
+			if err := os.Remove(upload.path); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to remove temporary file %s: %s\n", upload.path, err.Error())
+			}
+		}
+
+		q.mutex.Lock()
+		q.running--
+		q.mutex.Unlock()
+	}
+}
@@ -0,0 +1,173 @@
+package adapter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// lockRefreshInterval is how often held locks are touched, such that
+	// other processes can tell them apart from locks that were left behind by
+	// a process that died. Locks that were not touched for lockStaleAge are
+	// considered left behind.
+	lockRefreshInterval = 10 * time.Second
+	lockStaleAge        = time.Minute
+
+	// lockPollInterval is how often a held lock is checked while waiting for
+	// it.
+	lockPollInterval = 250 * time.Millisecond
+)
+
+// fetchLocks are lock files per object in a directory shared by all adapter
+// processes on the host. The process holding the lock of an object is the only
+// one looking the object up in the cache and downloading it from upstream, and
+// keeps the lock until the object was downloaded and added to the local cache,
+// or streamed into the cache. Other processes wait for the lock, and then find
+// the object in either cache instead of downloading it from upstream again.
+type fetchLocks struct {
+	directory string
+	held      map[string]string
+	mutex     sync.Mutex
+	stop      chan struct{}
+}
+
+func newFetchLocks(directory string) (*fetchLocks, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	locks := &fetchLocks{
+		directory: directory,
+		held:      make(map[string]string),
+		stop:      make(chan struct{}),
+	}
+	go locks.refreshPeriodically()
+	return locks, nil
+}
+
+func (l *fetchLocks) path(oid string) string {
+	return filepath.Join(l.directory, fmt.Sprintf("%s.lock", oid))
+}
+
+// lock takes the lock of the object, waiting for other processes holding it
+// first. If the lock cannot be taken at all, the object is processed without
+// it.
+func (l *fetchLocks) lock(oid string) {
+	if l == nil {
+		return
+	}
+	waiting := false
+	for {
+		locked, err := l.tryLock(oid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to lock object %s, continuing without lock. %s\n", oid, err.Error())
+			return
+		}
+		if locked {
+			return
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "Object %s is being downloaded by another process, waiting for it\n", oid)
+			waiting = true
+		}
+		l.wait(oid)
+	}
+}
+
+// tryLock takes the lock of the object, and returns false if another process
+// holds it. A lock that was left behind is removed first. Two processes may
+// remove the same lock that was left behind at the same time, in which case
+// both of them download the object, as if there were no locks.
+func (l *fetchLocks) tryLock(oid string) (bool, error) {
+	path := l.path(oid)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		if !isStale(path) {
+			return false, nil
+		}
+		fmt.Fprintf(os.Stderr, "Removing lock of object %s that was left behind\n", oid)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	file.Close()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.held[oid] = path
+	return true, nil
+}
+
+// wait waits until the lock of the object is released, or left behind.
+func (l *fetchLocks) wait(oid string) {
+	path := l.path(oid)
+	for {
+		if _, err := os.Stat(path); err != nil || isStale(path) {
+			return
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// unlock releases the lock of the object, if it is held by this process.
+func (l *fetchLocks) unlock(oid string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	path, ok := l.held[oid]
+	delete(l.held, oid)
+	l.mutex.Unlock()
+	if ok {
+		os.Remove(path)
+	}
+}
+
+// close releases all locks that are still held.
+func (l *fetchLocks) close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for oid, path := range l.held {
+		os.Remove(path)
+		delete(l.held, oid)
+	}
+}
+
+func (l *fetchLocks) refreshPeriodically() {
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			l.mutex.Lock()
+			for _, path := range l.held {
+				os.Chtimes(path, now, now)
+			}
+			l.mutex.Unlock()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// isStale returns whether the lock file was left behind by a process that
+// died.
+func isStale(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) > lockStaleAge
+}
@@ -1,29 +1,52 @@
 package adapter
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"time"
 
+	lfserrors "github.com/git-lfs/git-lfs/v3/errors"
 	"github.com/git-lfs/git-lfs/v3/tq"
 
 	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/daemon"
 	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/lfs"
 	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
 )
 
 type cachingHandler struct {
-	cacheAdapter *caching.S3CachingAdapter
-	client       *lfs.LFSTransferClient
-	output       *os.File
-	stats        *stats.Stats
-	tempdir      string
+	cacheAdapter    caching.Backend
+	cacheOnly       bool
+	cacheQueue      *cacheQueue
+	client          *lfs.LFSTransferClient
+	daemon          *daemon.Client
+	drainTimeout    time.Duration
+	fetchLocks      *fetchLocks
+	localCache      *caching.LocalCache
+	jobs            chan *inputMessage
+	output          *os.File
+	outputMutex     sync.Mutex
+	stats           *stats.Stats
+	shutdownOnce    sync.Once
+	statsMutex      sync.Mutex
+	streamedToCache sync.Map
+	tempdir         string
+	upstream        *upstreamQueue
+	workers         sync.WaitGroup
 }
 
 // newHandler creates a new handler for the protocol.
 func newHandler(output *os.File, msg *inputMessage) (*cachingHandler, error) {
 	config := lfs.GetPassthroughConfiguration()
+	cachingConfiguration := caching.GetCachingConfiguration(config)
+	concurrency := cachingConfiguration.ConcurrentTransfers()
+	lfs.SetConcurrentTransfers(config, concurrency)
 
 	tempdir, err := os.MkdirTemp(config.Filesystem().LFSStorageDir, "lfs-caching-adapter-*")
 	if err != nil {
@@ -35,18 +58,147 @@ func newHandler(output *os.File, msg *inputMessage) (*cachingHandler, error) {
 		return nil, err
 	}
 
-	cacheAdapter, err := caching.NewS3CachingAdapter(config)
+	// Cache operations are forwarded to the shared daemon if one is running,
+	// and performed by this process otherwise.
+	var cacheAdapter caching.Backend
+	daemonClient, err := dialDaemon(cachingConfiguration.DaemonSocketPath(), cachingConfiguration.WithoutSecrets(), config.Filesystem().LFSStorageDir)
 	if err != nil {
-		return nil, err
+		fmt.Fprintf(os.Stderr, "Failed to use cache daemon, running standalone instead. %s\n", err.Error())
+	}
+	if daemonClient != nil {
+		fmt.Fprintf(os.Stderr, "Forwarding cache operations to daemon at %s\n", cachingConfiguration.DaemonSocketPath())
+		if daemonClient.Enabled() {
+			cacheAdapter = daemonClient
+		} else {
+			fmt.Fprintf(os.Stderr, "Found no caching configuration for this repository. Not caching anything.\n")
+		}
+	} else {
+		cacheAdapter, err = caching.NewBackend(cachingConfiguration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var localCache *caching.LocalCache
+	if client.IsDownload() {
+		localCache, err = caching.NewLocalCache(cachingConfiguration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only downloads of objects that can be found in a cache afterwards are
+	// locked, otherwise waiting would not help.
+	var fetchLocks *fetchLocks
+	if client.IsDownload() && (cacheAdapter != nil || localCache != nil) {
+		directory, err := cachingConfiguration.LockDirectory()
+		if err == nil && directory != "" {
+			fetchLocks, err = newFetchLocks(directory)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up locks, objects may be downloaded by multiple processes at the same time. %s\n", err.Error())
+		}
 	}
 
-	return &cachingHandler{
+	handler := &cachingHandler{
 		cacheAdapter: cacheAdapter,
+		cacheOnly:    cachingConfiguration.CacheOnly(),
 		client:       client,
+		daemon:       daemonClient,
+		drainTimeout: cachingConfiguration.CacheDrainTimeout(),
+		fetchLocks:   fetchLocks,
+		jobs:         make(chan *inputMessage, concurrency),
+		localCache:   localCache,
 		output:       output,
 		stats:        stats.NewSessionStats(),
 		tempdir:      tempdir,
-	}, nil
+	}
+	if multiBackend, ok := cacheAdapter.(*caching.MultiBackend); ok {
+		multiBackend.UpdateStats = handler.updateStats
+	}
+	if daemonClient != nil {
+		daemonClient.UpdateStats = handler.updateStats
+	}
+	handler.upstream = newUpstreamQueue(client, cachingConfiguration.UpstreamBatchSize(), cachingConfiguration.UpstreamBatchWindow())
+	handler.upstream.OnProgress = handler.onProgress
+	handler.upstream.OnFinished = handler.onUpstreamFinished
+	if handler.cacheOnly && client.IsDownload() {
+		fmt.Fprintf(os.Stderr, "Running in cache-only mode, objects missing from the cache are not downloaded from upstream\n")
+	}
+	if cacheAdapter != nil {
+		handler.cacheQueue = newCacheQueue(concurrency, handler.addToCache)
+	}
+	if cacheAdapter != nil && client.IsDownload() && cachingConfiguration.StreamsToCache() {
+		if _, ok := caching.AsStreamingBackend(cacheAdapter); ok {
+			fmt.Fprintf(os.Stderr, "Streaming upstream downloads into the cache\n")
+			handler.upstream.Stream = handler.streamUpstream
+		} else {
+			fmt.Fprintf(os.Stderr, "Cache backend does not support streaming, adding upstream downloads to the cache afterwards instead\n")
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Processing up to %d transfers concurrently\n", concurrency)
+	for i := 0; i < concurrency; i++ {
+		handler.workers.Add(1)
+		go handler.worker()
+	}
+	return handler, nil
+}
+
+// worker performs queued upload and download actions until the job queue is
+// closed.
+func (h *cachingHandler) worker() {
+	defer h.workers.Done()
+	for msg := range h.jobs {
+		switch msg.Event {
+		case "upload":
+			h.upload(msg.Oid, msg.Size, msg.Path)
+		case "download":
+			h.download(msg.Oid, msg.Size)
+		}
+	}
+}
+
+// shutdown stops accepting new actions and waits for all queued actions and
+// upstream transfers to finish. Objects that are still being added to the cache
+// are waited for until the drain timeout passes.
+func (h *cachingHandler) shutdown() {
+	h.shutdownOnce.Do(func() {
+		close(h.jobs)
+		h.workers.Wait()
+		h.upstream.Close()
+		if h.cacheQueue != nil {
+			fmt.Fprintf(os.Stderr, "Waiting up to %s for objects to be added to cache\n", h.drainTimeout)
+			if abandoned := h.cacheQueue.Drain(h.drainTimeout); abandoned > 0 {
+				fmt.Fprintf(os.Stderr, "Timed out while adding objects to cache, %d object(s) are not cached for next download\n", abandoned)
+			}
+		}
+		h.fetchLocks.close()
+		if err := caching.CloseBackend(h.cacheAdapter); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to close cache backend: %s\n", err.Error())
+		}
+		if h.localCache != nil {
+			if err := h.localCache.Evict(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to evict objects from local cache: %s\n", err.Error())
+			}
+		}
+	})
+}
+
+// updateStats applies the given update to the session statistics, which are
+// shared by all workers.
+func (h *cachingHandler) updateStats(update func(s *stats.Stats)) {
+	h.statsMutex.Lock()
+	defer h.statsMutex.Unlock()
+	update(h.stats)
+}
+
+// send writes a single protocol message to Git LFS. Messages of concurrent
+// workers are never interleaved.
+func (h *cachingHandler) send(msg interface{}) {
+	h.outputMutex.Lock()
+	defer h.outputMutex.Unlock()
+	json.NewEncoder(h.output).Encode(msg)
 }
 
 func (h *cachingHandler) onUpstreamFinished(oid string, path string, size int64, result *tq.Transfer) {
@@ -56,12 +208,14 @@ func (h *cachingHandler) onUpstreamFinished(oid string, path string, size int64,
 		} else {
 			fmt.Fprintf(os.Stderr, "Expected download of object %s, but upstream transfer did not perform any action. Returning error.\n", oid)
 			h.complete(oid, path, fmt.Errorf("no action performed, but expected download of file %s", oid))
+			h.fetchLocks.unlock(oid)
 			return
 		}
 	} else {
 		if result.Error != nil {
 			fmt.Fprintf(os.Stderr, "Got a transfer result error for %s: %s\n", result.Oid, result.Error.Error())
 			h.complete(result.Oid, result.Path, errors.New(result.Error.Error()))
+			h.fetchLocks.unlock(result.Oid)
 			return
 		}
 		oid = result.Oid
@@ -69,33 +223,148 @@ func (h *cachingHandler) onUpstreamFinished(oid string, path string, size int64,
 		size = result.Size
 	}
 
+	h.updateStats(func(s *stats.Stats) {
+		if h.client.IsDownload() {
+			s.ObjectsPulled++
+			s.BytesTransferredFromRemote += uint64(size)
+		} else {
+			s.ObjectsPushed++
+			s.BytesTransferredToRemote += uint64(size)
+		}
+	})
+
+	var upload *cacheUpload
+	if _, streamed := h.streamedToCache.LoadAndDelete(oid); h.cacheAdapter != nil && !streamed {
+		upload = &cacheUpload{oid: oid, path: path, size: size}
+		if h.client.IsDownload() {
+			// Git LFS moves the downloaded file away once the download is
+			// completed, so keep a link to it for adding it to the cache.
+			upload.path = path + ".cache"
+			upload.temporary = true
+			if err := os.Link(path, upload.path); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to keep object %s for adding it to cache in the background. %s Adding it before completing the download instead.\n", oid, err.Error())
+				h.addToCache(&cacheUpload{oid: oid, path: path, size: size})
+				upload = nil
+			}
+		}
+	}
+
 	if h.client.IsDownload() {
-		h.stats.ObjectsPulled++
-		h.stats.BytesTransferredFromRemote += uint64(size)
-	} else {
-		h.stats.ObjectsPushed++
-		h.stats.BytesTransferredToRemote += uint64(size)
+		h.addToLocalCache(oid, path, size)
+	}
+	h.complete(oid, path, nil)
+	if upload != nil {
+		fmt.Fprintf(os.Stderr, "Queueing object %s to be added to cache\n", oid)
+		h.cacheQueue.Add(upload)
 	}
+	// The lock of the object is released once it was downloaded, instead of
+	// once it was added to the cache, such that waiting processes are not
+	// held up by a slow cache. They find the object in the local cache, or
+	// in the cache if it was added in the meantime.
+	h.fetchLocks.unlock(oid)
+}
 
-	if h.cacheAdapter != nil {
-		fmt.Fprintf(os.Stderr, "Adding object %s to cache\n", oid)
-		uploaded, err := h.cacheAdapter.Upload(path, oid, size)
-		if uploaded {
+// addToLocalCache copies a downloaded object into the local cache, if enabled.
+func (h *cachingHandler) addToLocalCache(oid string, path string, size int64) {
+	if h.localCache == nil {
+		return
+	}
+	if err := h.localCache.Add(path, oid, size); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while adding object %s to local cache. %s\n", oid, err.Error())
+	}
+}
+
+// addToCache uploads an object to the cache, unless it is in the cache already.
+func (h *cachingHandler) addToCache(upload *cacheUpload) {
+	fmt.Fprintf(os.Stderr, "Adding object %s to cache\n", upload.oid)
+	uploaded, err := h.cacheAdapter.Upload(upload.path, upload.oid, upload.size)
+	if uploaded {
+		h.updateStats(func(s *stats.Stats) {
 			if h.client.IsDownload() {
-				h.stats.CacheAddedDuringPull++
+				s.CacheAddedDuringPull++
 			} else {
-				h.stats.CacheAddedDuringPush++
+				s.CacheAddedDuringPush++
 			}
-			h.stats.BytesTransferredToCache += uint64(size)
-			fmt.Fprintf(os.Stderr, "Added object %s to cache\n", oid)
-		} else if err != nil {
-			fmt.Fprintf(os.Stderr, "Error while adding object %s to cache. %s Object is not cached for next download.\n", oid, err.Error())
-		} else {
-			fmt.Fprintf(os.Stderr, "Object %s is already in cache\n", oid)
-		}
+			s.BytesTransferredToCache += uint64(upload.size)
+		})
+		fmt.Fprintf(os.Stderr, "Added object %s to cache\n", upload.oid)
+	} else if errors.Is(err, caching.ErrInvalidObject) {
+		h.updateStats(func(s *stats.Stats) { s.CacheRejected++ })
+		fmt.Fprintf(os.Stderr, "Refusing to add object %s to cache. %s\n", upload.oid, err.Error())
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while adding object %s to cache. %s Object is not cached for next download.\n", upload.oid, err.Error())
+	} else {
+		fmt.Fprintf(os.Stderr, "Object %s is already in cache\n", upload.oid)
 	}
+}
 
-	h.complete(oid, path, nil)
+// streamUpstream downloads the object from upstream and uploads it to the cache
+// while it is written to disk. If the object could not be added to the cache,
+// it is uploaded again once the download finished.
+func (h *cachingHandler) streamUpstream(object *tq.Transfer) error {
+	body, err := h.client.OpenDownload(object)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(object.Path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	reader, writer := io.Pipe()
+	var uploaded bool
+	var uploadErr error
+	uploadDone := make(chan struct{})
+	go func() {
+		defer close(uploadDone)
+		streamingBackend, _ := caching.AsStreamingBackend(h.cacheAdapter)
+		uploaded, uploadErr = streamingBackend.UploadStream(reader, object.Oid, object.Size)
+		// Keep the download going if the upload stopped reading early.
+		io.Copy(io.Discard, reader)
+	}()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, hash, writer, &progressWriter{
+		progressCallback: func(bytesSoFar int64, bytesSinceLast int64) {
+			h.onProgress(object.Oid, object.Size, bytesSoFar, bytesSinceLast)
+		},
+	}), body)
+	if err != nil {
+		err = lfserrors.NewRetriableError(err)
+	} else if written != object.Size {
+		err = fmt.Errorf("expected %d bytes for object %s, got %d", object.Size, object.Oid, written)
+	} else if oid := hex.EncodeToString(hash.Sum(nil)); oid != object.Oid {
+		err = fmt.Errorf("expected OID %s, got %s after %d bytes written", object.Oid, oid, written)
+	}
+	if err != nil {
+		// Aborts the upload, such that the incomplete object never ends up
+		// in the cache.
+		writer.CloseWithError(err)
+		<-uploadDone
+		file.Close()
+		os.Remove(object.Path)
+		return err
+	}
+	writer.Close()
+	<-uploadDone
+
+	if uploaded {
+		h.updateStats(func(s *stats.Stats) {
+			s.CacheAddedDuringPull++
+			s.BytesTransferredToCache += uint64(object.Size)
+		})
+		h.streamedToCache.Store(object.Oid, true)
+		fmt.Fprintf(os.Stderr, "Streamed object %s into cache\n", object.Oid)
+	} else if uploadErr != nil {
+		fmt.Fprintf(os.Stderr, "Error while streaming object %s into cache. %s Will add it after the download instead.\n", object.Oid, uploadErr.Error())
+	} else {
+		h.streamedToCache.Store(object.Oid, true)
+		fmt.Fprintf(os.Stderr, "Object %s is already in cache\n", object.Oid)
+	}
+	return nil
 }
 
 func (h *cachingHandler) onProgress(oid string, totalSize int64, bytesSoFar int64, bytesSinceLast int64) error {
@@ -105,7 +374,7 @@ func (h *cachingHandler) onProgress(oid string, totalSize int64, bytesSoFar int6
 		BytesSoFar:     bytesSoFar,
 		BytesSinceLast: bytesSinceLast,
 	}
-	json.NewEncoder(h.output).Encode(response)
+	h.send(response)
 	return nil
 }
 
@@ -127,19 +396,19 @@ func (h *cachingHandler) complete(oid string, path string, err error) {
 	if err != nil {
 		response.Error = &errorMessage{Message: err.Error()}
 	}
-	json.NewEncoder(h.output).Encode(response)
+	h.send(response)
 }
 
-// dispatch dispatches the event depending on the message type.
+// dispatch dispatches the event depending on the message type. Uploads and
+// downloads are queued for the workers, such that reading the next message does
+// not have to wait for the transfer to finish.
 func (h *cachingHandler) dispatch(msg *inputMessage) bool {
 	switch msg.Event {
 	case "init":
 		fmt.Fprintf(os.Stderr, "Received initialization message\n")
-		fmt.Fprintln(h.output, "{}")
-	case "upload":
-		h.upload(msg.Oid, msg.Size, msg.Path)
-	case "download":
-		h.download(msg.Oid, msg.Size)
+		h.send(struct{}{})
+	case "upload", "download":
+		h.jobs <- msg
 	case "terminate":
 		h.terminate()
 		return false
@@ -165,36 +434,105 @@ func (h *cachingHandler) download(oid string, size int64) {
 	tmp.Close()
 	os.Remove(tmp.Name())
 
+	// The lock is released once the object was found in a cache, or
+	// downloaded from upstream.
+	h.fetchLocks.lock(oid)
+
+	if h.localCache != nil {
+		ok, err := h.localCache.Download(tmp.Name(), oid, size, func(bytesSoFar int64, bytesSinceLast int64) {
+			h.onProgress(oid, size, bytesSoFar, bytesSinceLast)
+		})
+		if ok {
+			h.updateStats(func(s *stats.Stats) {
+				s.ObjectsPulled++
+				s.LocalCacheHits++
+			})
+			fmt.Fprintf(os.Stderr, "Copied object %s from local cache to target %s\n", oid, tmp.Name())
+			h.complete(oid, tmp.Name(), nil)
+			h.fetchLocks.unlock(oid)
+			return
+		}
+		h.updateStats(func(s *stats.Stats) { s.LocalCacheMisses++ })
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Local cache error while obtaining object %s. %s\n", oid, err.Error())
+		}
+	}
+
 	if h.cacheAdapter != nil {
 		fmt.Fprintf(os.Stderr, "Trying to download object %s from cache, target: %s\n", oid, tmp.Name())
 		ok, err := h.cacheAdapter.Download(tmp.Name(), oid, size, func(bytesSoFar int64, bytesSinceLast int64) {
 			h.onProgress(oid, size, bytesSoFar, bytesSinceLast)
 		})
 		if ok {
-			h.stats.ObjectsPulled++
-			h.stats.CacheHits++
-			h.stats.BytesTransferredFromCache += uint64(size)
+			h.updateStats(func(s *stats.Stats) {
+				s.ObjectsPulled++
+				s.CacheHits++
+				s.BytesTransferredFromCache += uint64(size)
+			})
 			fmt.Fprintf(os.Stderr, "Downloaded object %s from cache to target %s\n", oid, tmp.Name())
+			h.addToLocalCache(oid, tmp.Name(), size)
 			h.complete(oid, tmp.Name(), err)
+			h.fetchLocks.unlock(oid)
 			return
 		} else if err == nil {
-			h.stats.CacheMisses++
+			h.updateStats(func(s *stats.Stats) { s.CacheMisses++ })
 			fmt.Fprintf(os.Stderr, "Cache miss for object %s. Will download upstream instead.\n", oid)
+		} else if errors.Is(err, caching.ErrCorruptObject) {
+			h.updateStats(func(s *stats.Stats) { s.CacheCorrupted++ })
+			fmt.Fprintf(os.Stderr, "Corrupt object %s in cache. %s Will download upstream instead.\n", oid, err.Error())
 		} else {
-			h.stats.CacheErrors++
+			h.updateStats(func(s *stats.Stats) { s.CacheErrors++ })
 			fmt.Fprintf(os.Stderr, "Cache error while obtaining object %s. %s Will download upstream instead.\n", oid, err.Error())
 		}
 	}
 
-	fmt.Fprintf(os.Stderr, "Passing uncached download of object %s to upstream adapter, target: %s\n", oid, tmp.Name())
-	h.upstreamTransfer(oid, tmp.Name(), size)
+	if h.cacheOnly {
+		h.updateStats(func(s *stats.Stats) { s.CacheOnlyRefusals++ })
+		fmt.Fprintf(os.Stderr, "Refusing to download object %s from upstream in cache-only mode\n", oid)
+		h.complete(oid, "", fmt.Errorf("object %s is not available in the cache, and downloading from upstream is disabled in cache-only mode", oid))
+		h.fetchLocks.unlock(oid)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Queueing uncached download of object %s for upstream adapter, target: %s\n", oid, tmp.Name())
+	h.upstream.Add(oid, tmp.Name(), size)
 }
 
 func (h *cachingHandler) terminate() error {
-	fmt.Fprintf(os.Stderr, "Received call to terminate, writing stats\n")
-	err := h.stats.Save()
-	if err != nil {
+	fmt.Fprintf(os.Stderr, "Received call to terminate, waiting for running transfers\n")
+	h.shutdown()
+	fmt.Fprintf(os.Stderr, "All transfers finished, writing stats\n")
+	if err := h.saveStats(); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed writing stats, ignoring...\n")
 	}
 	return h.client.Close()
 }
+
+// saveStats passes the session statistics to the daemon, which writes them
+// together with those of other sessions, or writes them directly if there is no
+// daemon.
+func (h *cachingHandler) saveStats() error {
+	// The statistics are copied, such that the mutex is not held while
+	// talking to the daemon, which may update the statistics itself.
+	h.statsMutex.Lock()
+	sessionStats := h.stats.Copy()
+	h.statsMutex.Unlock()
+	if h.daemon != nil {
+		err := h.daemon.SaveStats(sessionStats)
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Failed passing stats to daemon, writing them directly instead. %s\n", err.Error())
+	}
+	return sessionStats.Save()
+}
+
+// dialDaemon connects to the shared daemon for the caching configuration, if
+// one is running.
+func dialDaemon(socket string, configuration interface{}, storageDir string) (*daemon.Client, error) {
+	data, err := json.Marshal(configuration)
+	if err != nil {
+		return nil, err
+	}
+	return daemon.Dial(socket, data, storageDir)
+}
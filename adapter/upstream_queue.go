@@ -0,0 +1,305 @@
+package adapter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	lfserrors "github.com/git-lfs/git-lfs/v3/errors"
+	"github.com/git-lfs/git-lfs/v3/tq"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/lfs"
+)
+
+// upstreamQueue is a long-lived queue of upstream transfers for a session. It
+// collects transfers, such that the transfer actions for multiple objects are
+// requested from the upstream LFS API in a single batch request. A batch is
+// sent as soon as batchSize transfers are pending, or when the first pending
+// transfer has waited for batchWindow. All batches share a single transfer
+// adapter, which is ended when the queue is closed. If Stream is set, objects
+// that upstream offers for a basic transfer are passed to it instead of to the
+// transfer adapter.
+type upstreamQueue struct {
+	adapter      *sharedAdapter
+	adapterMutex sync.Mutex
+	batchSize    int
+	batchWindow  time.Duration
+	client       *lfs.LFSTransferClient
+	pending      []*queuedTransfer
+	pendingMutex sync.Mutex
+	timer        *time.Timer
+	transfers    sync.WaitGroup
+	OnProgress   func(oid string, totalSize int64, readSoFar int64, readSinceLast int64) error
+	OnFinished   func(oid string, path string, size int64, result *tq.Transfer)
+	Stream       func(object *tq.Transfer) error
+}
+
+// sharedAdapter is a transfer adapter that is shared by the batches in flight.
+// It is only ended once no batch is adding transfers to it or waiting for their
+// results anymore, as adding transfers to an adapter that was ended panics.
+type sharedAdapter struct {
+	tq.Adapter
+	users sync.WaitGroup
+}
+
+// end waits for all batches using the adapter, and then ends it.
+func (a *sharedAdapter) end() {
+	a.users.Wait()
+	a.End()
+}
+
+type queuedTransfer struct {
+	attempts int
+	oid      string
+	path     string
+	size     int64
+}
+
+func newUpstreamQueue(client *lfs.LFSTransferClient, batchSize int, batchWindow time.Duration) *upstreamQueue {
+	return &upstreamQueue{
+		batchSize:   batchSize,
+		batchWindow: batchWindow,
+		client:      client,
+		OnProgress:  nil,
+		OnFinished:  nil,
+		Stream:      nil,
+	}
+}
+
+// Add queues a transfer of the object with the given OID. OnFinished is called
+// once the transfer is done, failed or turned out to be unnecessary.
+func (q *upstreamQueue) Add(oid string, path string, size int64) {
+	q.transfers.Add(1)
+	q.enqueue(&queuedTransfer{
+		oid:  oid,
+		path: path,
+		size: size,
+	})
+}
+
+// Close sends any pending transfers and waits for all transfers to finish.
+func (q *upstreamQueue) Close() {
+	q.flush()
+	q.transfers.Wait()
+
+	q.adapterMutex.Lock()
+	defer q.adapterMutex.Unlock()
+	if q.adapter != nil {
+		q.adapter.end()
+		q.adapter = nil
+	}
+}
+
+func (q *upstreamQueue) enqueue(transfer *queuedTransfer) {
+	q.pendingMutex.Lock()
+	defer q.pendingMutex.Unlock()
+
+	q.pending = append(q.pending, transfer)
+	if len(q.pending) >= q.batchSize {
+		q.flushLocked()
+	} else if q.timer == nil {
+		q.timer = time.AfterFunc(q.batchWindow, q.flush)
+	}
+}
+
+func (q *upstreamQueue) flush() {
+	q.pendingMutex.Lock()
+	defer q.pendingMutex.Unlock()
+	q.flushLocked()
+}
+
+func (q *upstreamQueue) flushLocked() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	if len(q.pending) == 0 {
+		return
+	}
+	batch := q.pending
+	q.pending = nil
+	go q.send(batch)
+}
+
+// send requests the transfer actions for the batch and hands the objects that
+// need to be transferred to the transfer adapter. It blocks until all objects in
+// the batch are finished or queued for a retry.
+func (q *upstreamQueue) send(batch []*queuedTransfer) {
+	queued := make(map[string]*queuedTransfer, len(batch))
+	transfers := make([]*tq.Transfer, 0, len(batch))
+	for _, transfer := range batch {
+		if _, ok := queued[transfer.oid]; ok {
+			// The adapter only transfers an object once per batch, so
+			// postpone the duplicate to the next batch.
+			q.enqueue(transfer)
+			continue
+		}
+		queued[transfer.oid] = transfer
+		transfers = append(transfers, &tq.Transfer{Oid: transfer.oid, Size: transfer.size})
+	}
+
+	fmt.Fprintf(os.Stderr, "Requesting upstream %s actions for %d object(s) in a single batch\n", q.client.Operation(), len(transfers))
+	response, err := q.client.Batch(transfers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Upstream batch request failed: %s\n", err.Error())
+		for _, transfer := range queued {
+			q.retryOrFail(transfer, err)
+		}
+		return
+	}
+
+	inFlight := make(map[string]*queuedTransfer, len(queued))
+	var started []*tq.Transfer
+	for _, object := range response.Objects {
+		transfer, ok := queued[object.Oid]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Upstream batch response contains unknown object %s, ignoring\n", object.Oid)
+			continue
+		}
+		delete(queued, object.Oid)
+
+		if object.Error != nil {
+			q.finish(transfer, &tq.Transfer{Oid: transfer.oid, Path: transfer.path, Size: transfer.size, Error: object.Error})
+			continue
+		}
+		action, err := object.Rel(q.client.Operation())
+		if err != nil {
+			q.retryOrFail(transfer, err)
+			continue
+		}
+		if action == nil {
+			q.finish(transfer, nil)
+			continue
+		}
+		object.Name = transfer.oid
+		object.Path = transfer.path
+		started = append(started, object)
+		inFlight[object.Oid] = transfer
+	}
+	for oid, transfer := range queued {
+		q.fail(transfer, fmt.Errorf("upstream batch response did not contain object %s", oid))
+	}
+	if len(started) == 0 {
+		return
+	}
+
+	if q.Stream != nil && (response.TransferAdapterName == "" || response.TransferAdapterName == "basic") {
+		q.stream(started, inFlight)
+		return
+	}
+
+	adapter, err := q.beginAdapter(response.TransferAdapterName)
+	if err != nil {
+		for _, transfer := range inFlight {
+			q.fail(transfer, err)
+		}
+		return
+	}
+	defer adapter.users.Done()
+
+	// The result channel is only closed once all transfers of the adapter are
+	// done, including those of other batches, so read exactly one result per
+	// started transfer.
+	results := adapter.Add(started...)
+	for range started {
+		result := <-results
+		transfer := inFlight[result.Transfer.Oid]
+		if result.Error != nil {
+			q.retryOrFail(transfer, result.Error)
+			continue
+		}
+		q.finish(transfer, result.Transfer)
+	}
+}
+
+// stream passes the started objects to Stream, with at most the configured
+// number of concurrent transfers in flight. It blocks until all objects are
+// finished or queued for a retry.
+func (q *upstreamQueue) stream(started []*tq.Transfer, inFlight map[string]*queuedTransfer) {
+	slots := make(chan struct{}, q.client.ConcurrentTransfers())
+	var streams sync.WaitGroup
+	for _, object := range started {
+		slots <- struct{}{}
+		streams.Add(1)
+		go func(object *tq.Transfer) {
+			defer func() {
+				<-slots
+				streams.Done()
+			}()
+			transfer := inFlight[object.Oid]
+			if err := q.Stream(object); err != nil {
+				q.retryOrFail(transfer, err)
+				return
+			}
+			q.finish(transfer, object)
+		}(object)
+	}
+	streams.Wait()
+}
+
+// beginAdapter returns the running transfer adapter with the given name,
+// starting it if needed. The caller is counted as a user of the adapter until
+// it calls users.Done.
+func (q *upstreamQueue) beginAdapter(name string) (*sharedAdapter, error) {
+	q.adapterMutex.Lock()
+	defer q.adapterMutex.Unlock()
+
+	if q.adapter != nil {
+		if name == "" || q.adapter.Name() == name {
+			q.adapter.users.Add(1)
+			return q.adapter, nil
+		}
+		// The upstream server switched adapters between batches. This
+		// waits for the batches using the previous adapter to finish.
+		q.adapter.end()
+		q.adapter = nil
+	}
+
+	adapter, err := q.client.BeginAdapter(name, func(name string, totalSize int64, readSoFar int64, readSinceLast int) error {
+		if q.OnProgress != nil {
+			return q.OnProgress(name, totalSize, readSoFar, int64(readSinceLast))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.adapter = &sharedAdapter{Adapter: adapter}
+	q.adapter.users.Add(1)
+	return q.adapter, nil
+}
+
+// retryOrFail queues the transfer for another attempt if the error allows it,
+// and finishes it with the error otherwise.
+func (q *upstreamQueue) retryOrFail(transfer *queuedTransfer, err error) {
+	transfer.attempts++
+	if transfer.attempts < q.client.MaxRetries() {
+		if readyTime, ok := lfserrors.IsRetriableLaterError(err); ok {
+			fmt.Fprintf(os.Stderr, "Retrying upstream transfer of object %s at %s: %s\n", transfer.oid, readyTime.Format(time.RFC3339), err.Error())
+			time.AfterFunc(time.Until(readyTime), func() { q.enqueue(transfer) })
+			return
+		}
+		if lfserrors.IsRetriableError(err) {
+			fmt.Fprintf(os.Stderr, "Retrying upstream transfer of object %s: %s\n", transfer.oid, err.Error())
+			q.enqueue(transfer)
+			return
+		}
+	}
+	q.fail(transfer, err)
+}
+
+func (q *upstreamQueue) fail(transfer *queuedTransfer, err error) {
+	q.finish(transfer, &tq.Transfer{
+		Oid:   transfer.oid,
+		Path:  transfer.path,
+		Size:  transfer.size,
+		Error: &tq.ObjectError{Message: err.Error()},
+	})
+}
+
+func (q *upstreamQueue) finish(transfer *queuedTransfer, result *tq.Transfer) {
+	defer q.transfers.Done()
+	if q.OnFinished != nil {
+		q.OnFinished(transfer.oid, transfer.path, transfer.size, result)
+	}
+}
@@ -35,17 +35,21 @@ func NewUpstreamTransfer(client *lfs.LFSTransferClient, oid string, path string,
 	return transfer
 }
 
+// Perform runs the transfer and blocks until it is finished and OnFinished has
+// been called.
 func (u *upstreamTransfer) Perform() {
+	watch := u.transferQueue.Watch()
+	watchDone := make(chan struct{})
 	go func() {
-		for transfer := range u.transferQueue.Watch() {
+		defer close(watchDone)
+		for transfer := range watch {
 			u.completedTransfer = transfer
 		}
 	}()
 	u.transferQueue.Add(u.oid, u.path, u.oid, u.size, false, nil)
-	go func() {
-		u.transferQueue.Wait()
-		if u.OnFinished != nil {
-			u.OnFinished(u.oid, u.path, u.size, u.completedTransfer)
-		}
-	}()
+	u.transferQueue.Wait()
+	<-watchDone
+	if u.OnFinished != nil {
+		u.OnFinished(u.oid, u.path, u.size, u.completedTransfer)
+	}
 }
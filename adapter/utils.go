@@ -10,3 +10,16 @@ func standaloneFailure(msg string, err error) {
 	fmt.Fprintf(os.Stderr, "%s: %s\n", msg, err)
 	os.Exit(2)
 }
+
+// progressWriter reports the number of bytes written to it, without storing
+// them anywhere.
+type progressWriter struct {
+	writtenBytes     int64
+	progressCallback func(bytesSoFar int64, bytesSinceLast int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.writtenBytes += int64(len(p))
+	w.progressCallback(w.writtenBytes, int64(len(p)))
+	return len(p), nil
+}
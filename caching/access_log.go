@@ -0,0 +1,128 @@
+package caching
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// accessLogDirectory is the directory below the prefix that the access
+	// logs are stored in. Listings of the cache skip it, like any other key
+	// that is not an OID.
+	accessLogDirectory = ".access"
+
+	// accessLogInterval is how often the reads recorded by a process are
+	// written as a new access log.
+	accessLogInterval = 15 * time.Minute
+)
+
+// AccessLog holds the last time objects were read from the cache, as recorded
+// by the processes reading them.
+type AccessLog struct {
+	Accessed map[string]time.Time
+
+	// keys are the keys of the access log objects that were read.
+	keys []string
+}
+
+// add records that the object was read at the given time, unless a later read
+// was recorded already.
+func (l *AccessLog) add(oid string, accessed time.Time) {
+	if previous, ok := l.Accessed[oid]; !ok || accessed.After(previous) {
+		l.Accessed[oid] = accessed
+	}
+}
+
+// AccessLogBackend is a Backend that records when objects are read from the
+// cache, such that the least recently used objects can be removed.
+type AccessLogBackend interface {
+	Backend
+
+	// ReadAccessLog reads all access logs of the cache.
+	ReadAccessLog() (*AccessLog, error)
+
+	// CompactAccessLog replaces the access logs that were read into log by a
+	// single access log, which only holds the objects keep returns true for.
+	CompactAccessLog(log *AccessLog, keep func(oid string) bool) error
+}
+
+// accessRecorder collects the objects that are read from the cache, and writes
+// them as a new access log periodically and when it is closed. However often
+// an object is read, it is written at most once per interval, so recording
+// costs a single small object per interval and process.
+type accessRecorder struct {
+	accessed map[string]time.Time
+	mutex    sync.Mutex
+	stop     chan struct{}
+	stopped  chan struct{}
+	write    func(accessed map[string]time.Time) error
+}
+
+func newAccessRecorder(write func(accessed map[string]time.Time) error) *accessRecorder {
+	recorder := &accessRecorder{
+		accessed: make(map[string]time.Time),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		write:    write,
+	}
+	go recorder.writePeriodically()
+	return recorder
+}
+
+// record records that the object was read just now.
+func (r *accessRecorder) record(oid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.accessed[oid] = time.Now().UTC()
+}
+
+// flush writes the reads that were recorded since the last flush.
+func (r *accessRecorder) flush() error {
+	r.mutex.Lock()
+	accessed := r.accessed
+	r.accessed = make(map[string]time.Time)
+	r.mutex.Unlock()
+	if len(accessed) == 0 {
+		return nil
+	}
+	if err := r.write(accessed); err != nil {
+		return fmt.Errorf("failed to write access log: %v", err)
+	}
+	return nil
+}
+
+func (r *accessRecorder) writePeriodically() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(accessLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s, ignoring...\n", err.Error())
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// close writes the reads that were not written yet.
+func (r *accessRecorder) close() error {
+	close(r.stop)
+	<-r.stopped
+	return r.flush()
+}
+
+// accessLogName returns a new, unique name for an access log.
+func accessLogName() (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s.json", time.Now().UTC().Unix(), hex.EncodeToString(suffix)), nil
+}
@@ -0,0 +1,312 @@
+package caching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+const (
+	// azureAccountKeyEnvironmentVariable and azureSasTokenEnvironmentVariable
+	// provide the credentials when they are not configured, such that they do
+	// not have to be stored in the Git configuration.
+	azureAccountKeyEnvironmentVariable = "AZURE_STORAGE_KEY"
+	azureSasTokenEnvironmentVariable   = "AZURE_STORAGE_SAS_TOKEN"
+)
+
+var _ StreamingBackend = (*AzureBackend)(nil)
+
+// AzureBackend stores the cache in a container of an Azure Blob Storage
+// account. Objects are stored as block blobs, using the same keys as in S3.
+type AzureBackend struct {
+	client           *container.Client
+	configuration    *cachingConfiguration
+	partConcurrency  int
+	partSize         int64
+	rangeConcurrency int
+	rangeSize        int64
+}
+
+func NewAzureBackend(configuration *cachingConfiguration) (*AzureBackend, error) {
+	if configuration.Container == nil {
+		return nil, errors.New("no container configured for the Azure cache backend")
+	}
+	client, err := configuration.newAzureClient()
+	if err != nil {
+		return nil, err
+	}
+	// The URL of the client contains the SAS token, if any
+	fmt.Fprintf(os.Stderr, "Using Azure cache backend in container %s of %s\n", *configuration.Container, configuration.azureAccountName())
+	return &AzureBackend{
+		client:           client,
+		configuration:    configuration,
+		partConcurrency:  configuration.MultipartUploadConcurrency(),
+		partSize:         configuration.MultipartUploadPartSize(),
+		rangeConcurrency: configuration.DownloadRangeConcurrency(),
+		rangeSize:        configuration.DownloadRangeSize(),
+	}, nil
+}
+
+// newAzureClient creates a client for the configured container. Containers
+// are authenticated with the shared key of the account, or with a SAS token.
+func (c *cachingConfiguration) newAzureClient() (*container.Client, error) {
+	serviceURL := ""
+	if c.Endpoint != nil {
+		serviceURL = strings.TrimSuffix(*c.Endpoint, "/")
+	} else if c.Account != nil {
+		serviceURL = fmt.Sprintf("https://%s.blob.core.windows.net", *c.Account)
+	} else {
+		return nil, errors.New("no account or endpoint configured for the Azure cache backend")
+	}
+	containerURL := fmt.Sprintf("%s/%s", serviceURL, *c.Container)
+
+	accountKey := os.Getenv(azureAccountKeyEnvironmentVariable)
+	if c.AccountKey != nil {
+		accountKey = *c.AccountKey
+	}
+	sasToken := os.Getenv(azureSasTokenEnvironmentVariable)
+	if c.SasToken != nil {
+		sasToken = *c.SasToken
+	}
+
+	switch {
+	case accountKey != "":
+		if c.Account == nil {
+			return nil, errors.New("no account configured for the shared key of the Azure cache backend")
+		}
+		credential, err := azblob.NewSharedKeyCredential(*c.Account, accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure account key: %v", err)
+		}
+		return container.NewClientWithSharedKeyCredential(containerURL, credential, azureClientOptions())
+	case sasToken != "":
+		return container.NewClientWithNoCredential(fmt.Sprintf("%s?%s", containerURL, strings.TrimPrefix(sasToken, "?")), azureClientOptions())
+	default:
+		return nil, errors.New("no account key or SAS token configured for the Azure cache backend")
+	}
+}
+
+// azureClientOptions returns the options of the Azure clients, which keep SAS
+// tokens out of the errors of failed requests.
+func azureClientOptions() *container.ClientOptions {
+	return &container.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Transport: &redactingTransport{client: http.DefaultClient},
+		},
+	}
+}
+
+// redactingTransport sends the requests of the Azure clients. Errors of the
+// HTTP client contain the URL of the request, which contains the SAS token, so
+// the query is removed from them.
+type redactingTransport struct {
+	client *http.Client
+}
+
+func (t *redactingTransport) Do(request *http.Request) (*http.Response, error) {
+	response, err := t.client.Do(request)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if parsed, parseErr := url.Parse(urlErr.URL); parseErr == nil && parsed.RawQuery != "" {
+			parsed.RawQuery = "REDACTED"
+			err = &url.Error{Op: urlErr.Op, URL: parsed.String(), Err: urlErr.Err}
+		}
+	}
+	return response, err
+}
+
+// azureAccountName returns the configured account, or the endpoint if no
+// account is configured, for logging.
+func (c *cachingConfiguration) azureAccountName() string {
+	if c.Account != nil {
+		return fmt.Sprintf("account %s", *c.Account)
+	}
+	endpoint, err := url.Parse(*c.Endpoint)
+	if err != nil {
+		return "the configured endpoint"
+	}
+	return fmt.Sprintf("endpoint %s://%s%s", endpoint.Scheme, endpoint.Host, endpoint.Path)
+}
+
+func (b *AzureBackend) blob(oid string) *blockblob.Client {
+	return b.client.NewBlockBlobClient(b.configuration.keyPrefix() + oid)
+}
+
+func (b *AzureBackend) Exists(oid string, size int64) (bool, error) {
+	properties, err := b.blob(oid).GetProperties(context.Background(), nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if *properties.ContentLength != size {
+		return false, fmt.Errorf("object size mismatch: expected %d, got %d", size, *properties.ContentLength)
+	}
+	return true, nil
+}
+
+func (b *AzureBackend) Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	if ok, err := b.Exists(oid, size); !ok {
+		return false, err
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return false, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	// Download the blob in multiple ranges at the same time. The SDK reports
+	// the total progress of all ranges, which is turned into increments here.
+	var mutex sync.Mutex
+	bytesSoFar := int64(0)
+	_, err = b.blob(oid).DownloadFile(context.Background(), file, &blob.DownloadFileOptions{
+		BlockSize:   b.rangeSize,
+		Concurrency: uint16(min(b.rangeConcurrency, 1<<16-1)),
+		Progress: func(bytesTransferred int64) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if progressCallback != nil && bytesTransferred > bytesSoFar {
+				progressCallback(bytesTransferred, bytesTransferred-bytesSoFar)
+			}
+			bytesSoFar = max(bytesSoFar, bytesTransferred)
+		},
+		RetryReaderOptionsPerBlock: blob.RetryReaderOptions{MaxRetries: partAttempts},
+	})
+	if err != nil {
+		file.Close()
+		os.Remove(dest)
+		return false, fmt.Errorf("failed to download object: %v", err)
+	}
+
+	// Verify that the contents of the file match the OID
+	if err := verifyFile(file, oid, size); err != nil {
+		file.Close()
+		os.Remove(dest)
+		if !errors.Is(err, ErrInvalidObject) {
+			return false, err
+		}
+		return false, removeCorruptObject(b, b.configuration.writable(), oid, size, err, b.verifyStored)
+	}
+
+	return true, nil
+}
+
+// verifyStored reads the blob in full, in a single request, and checks whether
+// it matches its OID.
+func (b *AzureBackend) verifyStored(oid string, size int64) error {
+	response, err := b.blob(oid).DownloadStream(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return verifyStream(response.Body, oid, size)
+}
+
+func (b *AzureBackend) Upload(source string, oid string, size int64) (bool, error) {
+	uploaded, err := b.Exists(oid, size)
+	if uploaded && err == nil {
+		return false, nil
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return false, fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer file.Close()
+
+	// Make sure that the cache is never poisoned with objects that do not
+	// match their OID
+	if err := verifyFile(file, oid, size); err != nil {
+		return false, err
+	}
+
+	_, err = b.blob(oid).UploadFile(context.Background(), file, &blockblob.UploadFileOptions{
+		BlockSize:   b.partSize,
+		Concurrency: uint16(min(b.partConcurrency, 1<<16-1)),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to upload file to Azure: %v", err)
+	}
+
+	return true, nil
+}
+
+// UploadStream uploads the object in blocks while it is read from the reader.
+// The blocks are only committed once the whole object is read and verified, so
+// an object that does not match its OID never becomes visible.
+func (b *AzureBackend) UploadStream(reader io.Reader, oid string, size int64) (bool, error) {
+	uploaded, err := b.Exists(oid, size)
+	if uploaded && err == nil {
+		return false, nil
+	}
+
+	verifier := newVerifyingReader(reader, oid, size)
+	_, err = b.blob(oid).UploadStream(context.Background(), verifier, &blockblob.UploadStreamOptions{
+		BlockSize:   b.partSize,
+		Concurrency: b.partConcurrency,
+	})
+	if verifier.err != nil {
+		return false, verifier.err
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to upload file to Azure: %v", err)
+	}
+
+	return true, nil
+}
+
+func (b *AzureBackend) Delete(oid string) error {
+	_, err := b.blob(oid).Delete(context.Background(), nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	return nil
+}
+
+func (b *AzureBackend) List(callback func(object *Object) error) error {
+	prefix := b.configuration.keyPrefix()
+	pager := b.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix: &prefix,
+	})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %v", err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			oid := strings.TrimPrefix(*item.Name, prefix)
+			if !oidPattern.MatchString(oid) || item.Properties == nil {
+				continue
+			}
+			object := &Object{Oid: oid}
+			if item.Properties.ContentLength != nil {
+				object.Size = *item.Properties.ContentLength
+			}
+			if item.Properties.LastModified != nil {
+				object.LastModified = *item.Properties.LastModified
+			}
+			if item.Properties.AccessTier != nil {
+				object.StorageClass = string(*item.Properties.AccessTier)
+			}
+			if err := callback(object); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package caching
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrCorruptObject is returned when an object in the cache does not match its
+// OID. The object is removed from the cache when this happens.
+var ErrCorruptObject = errors.New("corrupt object in cache")
+
+// ErrInvalidObject is returned when an object that is added to the cache does
+// not match its OID. Such objects are never stored in the cache.
+var ErrInvalidObject = errors.New("object does not match its OID")
+
+// removeCorruptObject handles an object that did not match its OID after it was
+// downloaded from the cache. The download itself may have been broken instead
+// of the stored object, e.g. by a proxy rewriting the response, so the stored
+// object is read again in full by verify first. The object is only removed from
+// the cache if it does not match its OID again, and the cache is writable. The
+// returned error only wraps ErrCorruptObject if the stored object is corrupt.
+func removeCorruptObject(backend Backend, writable bool, oid string, size int64, downloadErr error, verify func(oid string, size int64) error) error {
+	err := verify(oid, size)
+	if err == nil {
+		return fmt.Errorf("failed to download object, although the object in the cache is valid: %v", downloadErr)
+	}
+	if !errors.Is(err, ErrInvalidObject) {
+		return fmt.Errorf("failed to download object: %v, and failed to verify the object in the cache: %v", downloadErr, err)
+	}
+	err = fmt.Errorf("%w: %v", ErrCorruptObject, err)
+	if !writable {
+		return fmt.Errorf("%w, not removing it from read-only cache", err)
+	}
+	if deleteErr := backend.Delete(oid); deleteErr != nil {
+		return fmt.Errorf("%w, and failed to remove it: %v", err, deleteErr)
+	}
+	return err
+}
+
+// Backend is a store for cached Git LFS objects.
+type Backend interface {
+	// Exists returns whether the object with the given OID and size is in
+	// the cache.
+	Exists(oid string, size int64) (bool, error)
+
+	// Download downloads the object from the cache to dest. It returns false
+	// without an error if the object is not in the cache.
+	Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error)
+
+	// Upload adds the object at source to the cache. It returns false without
+	// an error if the object is in the cache already.
+	Upload(source string, oid string, size int64) (bool, error)
+
+	// Delete removes the object from the cache.
+	Delete(oid string) error
+
+	// List calls callback for every object in the cache, until it returns an
+	// error.
+	List(callback func(object *Object) error) error
+}
+
+// StreamingBackend is a Backend that can add objects to the cache while they
+// are read from a stream.
+type StreamingBackend interface {
+	Backend
+
+	// UploadStream adds the object that is read from reader to the cache. It
+	// returns false without an error if the object is in the cache already.
+	UploadStream(reader io.Reader, oid string, size int64) (bool, error)
+}
+
+// AsStreamingBackend returns the backend as a StreamingBackend, if objects can be
+// added to it while they are read from a stream.
+func AsStreamingBackend(backend Backend) (StreamingBackend, bool) {
+	if multiBackend, ok := backend.(*MultiBackend); ok {
+		return multiBackend, multiBackend.streamingTarget() != nil
+	}
+	streamingBackend, ok := backend.(StreamingBackend)
+	return streamingBackend, ok
+}
+
+// Object describes an object in the cache.
+type Object struct {
+	Oid          string
+	Size         int64
+	LastModified time.Time
+	StorageClass string
+}
+
+// CloseBackend closes the backend, if it needs to be closed. Backends may
+// buffer work, such as recording which objects were read, until they are
+// closed.
+func CloseBackend(backend Backend) error {
+	if closer, ok := backend.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// NewBackend creates the cache backend selected in the configuration. It
+// returns nil if caching is not configured.
+func NewBackend(configuration *cachingConfiguration) (Backend, error) {
+	if !configuration.enabled() {
+		fmt.Fprintf(os.Stderr, "Found no caching configuration for this repository. Not caching anything.\n")
+		return nil, nil
+	}
+
+	if len(configuration.Targets) > 0 {
+		backend, err := NewMultiBackend(configuration)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	}
+
+	if command, ok := strings.CutPrefix(configuration.backend(), backendCommand); ok {
+		backend, err := NewCommandBackend(configuration, command)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	}
+
+	switch configuration.backend() {
+	case backendAzure:
+		backend, err := NewAzureBackend(configuration)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case backendFilesystem:
+		backend, err := NewFilesystemBackend(configuration)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case backendGCS:
+		backend, err := NewGCSBackend(configuration)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case backendHTTP:
+		backend, err := NewHTTPBackend(configuration)
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case backendS3:
+		adapter, err := NewS3CachingAdapter(configuration)
+		if err != nil {
+			return nil, err
+		}
+		return adapter, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", configuration.backend())
+	}
+}
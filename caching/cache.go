@@ -1,51 +1,88 @@
 package caching
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/git-lfs/git-lfs/v3/config"
 )
 
+var _ StreamingBackend = (*S3CachingAdapter)(nil)
+var _ AccessLogBackend = (*S3CachingAdapter)(nil)
+
 type S3CachingAdapter struct {
-	client        *s3.Client
-	configuration *cachingConfiguration
+	accessRecorder     *accessRecorder
+	client             *s3.Client
+	configuration      *cachingConfiguration
+	multipartThreshold int64
+	partConcurrency    int
+	partSize           int64
+	rangeConcurrency   int
+	rangeSize          int64
 }
 
-func NewS3CachingAdapter(cfg *config.Configuration) (*S3CachingAdapter, error) {
-	configuration := GetCachingConfiguration(cfg)
-	if !configuration.enabled() {
-		fmt.Fprintf(os.Stderr, "Found no caching configuration for this repository. Not caching anything.\n")
-		return nil, nil
+func NewS3CachingAdapter(configuration *cachingConfiguration) (*S3CachingAdapter, error) {
+	if configuration.Bucket == nil {
+		return nil, errors.New("no bucket configured for the S3 caching adapter")
 	}
-	jsonConfiguration, err := json.Marshal(configuration)
+	jsonConfiguration, err := json.Marshal(configuration.WithoutSecrets())
 	if err == nil {
 		fmt.Fprintf(os.Stderr, "Using S3 caching adapter with configuration %s\n", jsonConfiguration)
 	} else {
-		fmt.Fprintf(os.Stderr, "Using S3 caching adapter with configuration %+v\n", configuration)
+		fmt.Fprintf(os.Stderr, "Using S3 caching adapter with configuration %+v\n", configuration.WithoutSecrets())
 	}
 	client, err := configuration.newClient()
 	if err != nil {
 		return nil, err
 	}
-	return &S3CachingAdapter{
-		client:        client,
-		configuration: configuration,
-	}, nil
+	adapter := &S3CachingAdapter{
+		client:             client,
+		configuration:      configuration,
+		multipartThreshold: configuration.MultipartUploadThreshold(),
+		partConcurrency:    configuration.MultipartUploadConcurrency(),
+		partSize:           configuration.MultipartUploadPartSize(),
+		rangeConcurrency:   configuration.DownloadRangeConcurrency(),
+		rangeSize:          configuration.DownloadRangeSize(),
+	}
+	if configuration.RecordsAccess() {
+		adapter.accessRecorder = newAccessRecorder(adapter.writeAccessLog)
+	}
+	return adapter, nil
+}
+
+// Close writes the objects that were read from the cache, but not yet recorded
+// in an access log.
+func (a *S3CachingAdapter) Close() error {
+	if a.accessRecorder == nil {
+		return nil
+	}
+	return a.accessRecorder.close()
+}
+
+func (a *S3CachingAdapter) key(oid string) *string {
+	return aws.String(fmt.Sprintf("%s/%s", *a.configuration.Prefix, oid))
+}
+
+func (a *S3CachingAdapter) Exists(oid string, size int64) (bool, error) {
+	return a.exists(context.Background(), oid, size)
 }
 
 func (a *S3CachingAdapter) exists(ctx context.Context, oid string, size int64) (bool, error) {
 	object, err := a.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: a.configuration.Bucket,
-		Key:    aws.String(fmt.Sprintf("%s/%s", *a.configuration.Prefix, oid)),
+		Key:    a.key(oid),
 	})
 	if err != nil {
 		var responseError *awshttp.ResponseError
@@ -65,32 +102,69 @@ func (a *S3CachingAdapter) Download(dest string, oid string, size int64, progres
 		return false, err
 	}
 
-	// Download the object from the S3 bucket
-	resp, err := a.client.GetObject(context.Background(), &s3.GetObjectInput{
-		Bucket: a.configuration.Bucket,
-		Key:    aws.String(fmt.Sprintf("%s/%s", *a.configuration.Prefix, oid)),
-	})
-	if err != nil {
-		return false, fmt.Errorf("failed to download object: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Create the destination file
+	// Create the destination file, with room for the entire object
 	file, err := os.Create(dest)
 	if err != nil {
 		return false, fmt.Errorf("failed to create file: %v", err)
 	}
 	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		os.Remove(dest)
+		return false, fmt.Errorf("failed to allocate file: %v", err)
+	}
 
-	// Write resp.Body to the file with progress indicator
-	_, err = io.Copy(file, &progressReader{reader: resp.Body, progressCallback: progressCallback})
-	if err != nil {
-		return false, fmt.Errorf("failed to write to file: %v", err)
+	// Download the object from the S3 bucket, in multiple ranges at the same
+	// time if it is large enough
+	progress := &downloadProgress{progressCallback: progressCallback}
+	if err := downloadRanges(file, oid, size, a.rangeConcurrency, a.rangeSize, progress, a.rangeOpener(oid, size)); err != nil {
+		os.Remove(dest)
+		return false, err
 	}
 
+	// Verify that the contents of the file match the OID
+	if err := verifyFile(file, oid, size); err != nil {
+		file.Close()
+		os.Remove(dest)
+		if !errors.Is(err, ErrInvalidObject) {
+			return false, err
+		}
+		return false, removeCorruptObject(a, a.configuration.writable(), oid, size, err, a.verifyStored)
+	}
+
+	if a.accessRecorder != nil {
+		a.accessRecorder.record(oid)
+	}
 	return true, nil
 }
 
+// verifyStored reads the object in the bucket in full, without ranges, and
+// checks whether it matches its OID.
+func (a *S3CachingAdapter) verifyStored(oid string, size int64) error {
+	object, err := a.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: a.configuration.Bucket,
+		Key:    a.key(oid),
+	}, func(o *s3.Options) {
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+	return verifyStream(object.Body, oid, size)
+}
+
+// Delete removes the object with the given OID from the cache.
+func (a *S3CachingAdapter) Delete(oid string) error {
+	_, err := a.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: a.configuration.Bucket,
+		Key:    a.key(oid),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	return nil
+}
+
 func (a *S3CachingAdapter) Upload(source string, oid string, size int64) (bool, error) {
 	uploaded, err := a.exists(context.Background(), oid, size)
 	if uploaded && err == nil {
@@ -104,10 +178,25 @@ func (a *S3CachingAdapter) Upload(source string, oid string, size int64) (bool,
 	}
 	defer file.Close()
 
+	// Make sure that the cache is never poisoned with objects that do not
+	// match their OID
+	if err := verifyFile(file, oid, size); err != nil {
+		return false, err
+	}
+
+	// Upload large files in parts, which is faster and required for files
+	// larger than 5 GB
+	if size > a.multipartThreshold {
+		if err := a.uploadMultipart(file, oid, size); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
 	// Upload the file to the S3 bucket
 	_, err = a.client.PutObject(context.Background(), &s3.PutObjectInput{
 		Bucket: a.configuration.Bucket,
-		Key:    aws.String(fmt.Sprintf("%s/%s", *a.configuration.Prefix, oid)),
+		Key:    a.key(oid),
 		Body:   file,
 	})
 	if err != nil {
@@ -116,3 +205,215 @@ func (a *S3CachingAdapter) Upload(source string, oid string, size int64) (bool,
 
 	return true, nil
 }
+
+// UploadStream uploads an object of the given size to the S3 bucket while it is
+// read from the reader, such that it does not have to be stored first. Objects
+// larger than a single part are uploaded using a multipart upload.
+func (a *S3CachingAdapter) UploadStream(reader io.Reader, oid string, size int64) (bool, error) {
+	uploaded, err := a.exists(context.Background(), oid, size)
+	if uploaded && err == nil {
+		return false, nil
+	}
+
+	hash := sha256.New()
+	reader = io.TeeReader(reader, hash)
+
+	// Objects smaller than a single part are read entirely, with room for one
+	// more byte to detect objects that are larger than announced.
+	partSize := a.partSizeFor(size)
+	data := make([]byte, min(partSize, size+1))
+	n, err := io.ReadFull(reader, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if actual := hex.EncodeToString(hash.Sum(nil)); int64(n) != size || actual != oid {
+			return false, fmt.Errorf("%w: expected OID %s of %d bytes, got %s of %d bytes", ErrInvalidObject, oid, size, actual, n)
+		}
+		_, err = a.client.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket:        a.configuration.Bucket,
+			Key:           a.key(oid),
+			Body:          bytes.NewReader(data[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to upload file to S3: %v", err)
+		}
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to read object: %v", err)
+	} else if int64(n) > size {
+		return false, fmt.Errorf("%w: expected OID %s of %d bytes, got more bytes", ErrInvalidObject, oid, size)
+	}
+
+	upload, err := a.newMultipartUpload(context.Background(), oid)
+	if err != nil {
+		return false, err
+	}
+	total := int64(0)
+	for number := int32(1); n > 0; number++ {
+		total += int64(n)
+		upload.uploadPart(number, bytes.NewReader(data[:n]))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		data = make([]byte, partSize)
+		n, err = io.ReadFull(reader, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			upload.abort()
+			return false, fmt.Errorf("failed to read object: %v", err)
+		}
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); total != size || actual != oid {
+		upload.abort()
+		return false, fmt.Errorf("%w: expected OID %s of %d bytes, got %s of %d bytes", ErrInvalidObject, oid, size, actual, total)
+	}
+	if err := upload.complete(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (a *S3CachingAdapter) List(callback func(object *Object) error) error {
+	prefix := fmt.Sprintf("%s/", *a.configuration.Prefix)
+	paginator := s3.NewListObjectsV2Paginator(a.client, &s3.ListObjectsV2Input{
+		Bucket: a.configuration.Bucket,
+		Prefix: aws.String(prefix),
+	})
+	previousToken := ""
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %v", err)
+		}
+		// A page that points at itself as the next page would otherwise
+		// be listed forever.
+		if aws.ToBool(page.IsTruncated) {
+			token := aws.ToString(page.NextContinuationToken)
+			if token == "" || token == previousToken {
+				return errors.New("failed to list objects: listing does not continue after a truncated page")
+			}
+			previousToken = token
+		}
+		for _, object := range page.Contents {
+			oid := strings.TrimPrefix(aws.ToString(object.Key), prefix)
+			if !oidPattern.MatchString(oid) {
+				continue
+			}
+			err := callback(&Object{
+				Oid:          oid,
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+				StorageClass: string(object.StorageClass),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *S3CachingAdapter) accessLogPrefix() string {
+	return fmt.Sprintf("%s/%s/", *a.configuration.Prefix, accessLogDirectory)
+}
+
+// writeAccessLog writes the given reads as a new access log object.
+func (a *S3CachingAdapter) writeAccessLog(accessed map[string]time.Time) error {
+	name, err := accessLogName()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(accessed)
+	if err != nil {
+		return err
+	}
+	_, err = a.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        a.configuration.Bucket,
+		Key:           aws.String(a.accessLogPrefix() + name),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String("application/json"),
+	})
+	return err
+}
+
+// ReadAccessLog reads and merges all access log objects below the prefix.
+// Access logs that cannot be decoded are ignored, but still replaced when the
+// access log is compacted.
+func (a *S3CachingAdapter) ReadAccessLog() (*AccessLog, error) {
+	log := &AccessLog{Accessed: make(map[string]time.Time)}
+	paginator := s3.NewListObjectsV2Paginator(a.client, &s3.ListObjectsV2Input{
+		Bucket: a.configuration.Bucket,
+		Prefix: aws.String(a.accessLogPrefix()),
+	})
+	previousToken := ""
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list access logs: %v", err)
+		}
+		if aws.ToBool(page.IsTruncated) {
+			token := aws.ToString(page.NextContinuationToken)
+			if token == "" || token == previousToken {
+				return nil, errors.New("failed to list access logs: listing does not continue after a truncated page")
+			}
+			previousToken = token
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			accessed, err := a.readAccessLogObject(key)
+			if err != nil {
+				return nil, err
+			}
+			for oid, accessedAt := range accessed {
+				log.add(oid, accessedAt)
+			}
+			log.keys = append(log.keys, key)
+		}
+	}
+	return log, nil
+}
+
+func (a *S3CachingAdapter) readAccessLogObject(key string) (map[string]time.Time, error) {
+	object, err := a.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: a.configuration.Bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access log %s: %v", key, err)
+	}
+	defer object.Body.Close()
+	var accessed map[string]time.Time
+	if err := json.NewDecoder(object.Body).Decode(&accessed); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid access log %s, ignoring... %s\n", key, err.Error())
+		return nil, nil
+	}
+	return accessed, nil
+}
+
+// CompactAccessLog writes the reads of the objects that are kept as a single
+// access log, and then removes the access logs that were read. Reads that are
+// recorded in the meantime are written to new access logs, and are not lost.
+func (a *S3CachingAdapter) CompactAccessLog(log *AccessLog, keep func(oid string) bool) error {
+	accessed := make(map[string]time.Time)
+	for oid, accessedAt := range log.Accessed {
+		if keep(oid) {
+			accessed[oid] = accessedAt
+		}
+	}
+	if len(accessed) > 0 {
+		if err := a.writeAccessLog(accessed); err != nil {
+			return fmt.Errorf("failed to write access log: %v", err)
+		}
+	}
+	for _, key := range log.keys {
+		_, err := a.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+			Bucket: a.configuration.Bucket,
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete access log %s: %v", key, err)
+		}
+	}
+	return nil
+}
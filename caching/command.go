@@ -0,0 +1,387 @@
+package caching
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Backend = (*CommandBackend)(nil)
+
+// errCommandBackendClosed is returned for requests after the command backend
+// was closed.
+var errCommandBackendClosed = errors.New("command cache backend is closed")
+
+// commandInitRequest is the first request sent to a helper of the command
+// backend, before any other request.
+type commandInitRequest struct {
+	Event  string `json:"event"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// commandObjectRequest is a request of the command backend for a single object.
+// Path is only filled in on get and put requests.
+type commandObjectRequest struct {
+	Event string `json:"event"`
+	Oid   string `json:"oid"`
+	Size  int64  `json:"size"`
+	Path  string `json:"path,omitempty"`
+}
+
+// commandRequest is a request of the command backend without any arguments.
+type commandRequest struct {
+	Event string `json:"event"`
+}
+
+// commandResponse is a message from a helper of the command backend. Helpers
+// answer every request with any number of progress or object messages,
+// followed by a single complete message. Not all fields are filled in on all
+// messages.
+type commandResponse struct {
+	Event          string        `json:"event"`
+	Oid            string        `json:"oid"`
+	Found          bool          `json:"found"`
+	Stored         bool          `json:"stored"`
+	BytesSoFar     int64         `json:"bytesSoFar"`
+	BytesSinceLast int64         `json:"bytesSinceLast"`
+	Size           int64         `json:"size"`
+	LastModified   time.Time     `json:"lastModified"`
+	StorageClass   string        `json:"storageClass"`
+	Error          *errorMessage `json:"error,omitempty"`
+}
+
+// errorMessage is the error of a failed request.
+type errorMessage struct {
+	Message string `json:"message"`
+}
+
+// commandRequestError is an error returned by the helper for a request. The
+// helper can handle new requests after such errors.
+type commandRequestError struct {
+	message string
+}
+
+func (e *commandRequestError) Error() string {
+	return e.message
+}
+
+// CommandBackend stores the cache using an external helper program, which
+// speaks a line based JSON protocol on its standard input and output. Objects
+// are passed to and from the helper as files. Every helper handles a single
+// request at a time, so up to the number of concurrent transfers of the
+// session are started. The helper is run through the shell, like Git runs
+// its helpers, so the command may contain arguments and quoted paths.
+type CommandBackend struct {
+	command       string
+	configuration *cachingConfiguration
+	idle          chan *commandProcess
+	started       chan struct{}
+
+	// closed is set once the backend is closed, after which helpers are
+	// terminated when they become idle. mutex guards it, and makes sure
+	// no helper becomes idle while the idle helpers are terminated.
+	closed bool
+	mutex  sync.Mutex
+}
+
+// commandProcess is a running helper of the command backend.
+type commandProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func NewCommandBackend(configuration *cachingConfiguration, command string) (*CommandBackend, error) {
+	if strings.TrimSpace(command) == "" {
+		return nil, errors.New("no command configured for the command cache backend")
+	}
+	fmt.Fprintf(os.Stderr, "Using command cache backend with helper %s\n", command)
+	processes := configuration.ConcurrentTransfers()
+	backend := &CommandBackend{
+		command:       command,
+		configuration: configuration,
+		idle:          make(chan *commandProcess, processes),
+		started:       make(chan struct{}, processes),
+	}
+
+	// Start the first helper right away, such that a broken helper shows up
+	// once instead of on every object.
+	process, err := backend.acquire()
+	if err != nil {
+		return nil, err
+	}
+	backend.release(process, nil)
+	return backend, nil
+}
+
+// start starts a new helper, and initializes it.
+func (b *CommandBackend) start() (*commandProcess, error) {
+	cmd := exec.Command("sh", "-c", b.command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start cache helper: %v", err)
+	}
+	process := &commandProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}
+
+	request := &commandInitRequest{Event: "init"}
+	if b.configuration.Prefix != nil {
+		request.Prefix = *b.configuration.Prefix
+	}
+	if _, err := process.request(request, nil); err != nil {
+		process.close()
+		return nil, fmt.Errorf("failed to initialize cache helper: %v", err)
+	}
+	return process, nil
+}
+
+// acquire returns an idle helper, or starts a new one if all helpers are busy
+// and more helpers are allowed. Otherwise, it waits for a helper to become
+// idle.
+func (b *CommandBackend) acquire() (*commandProcess, error) {
+	b.mutex.Lock()
+	closed := b.closed
+	b.mutex.Unlock()
+	if closed {
+		return nil, errCommandBackendClosed
+	}
+	select {
+	case process := <-b.idle:
+		return process, nil
+	default:
+	}
+	select {
+	case process := <-b.idle:
+		return process, nil
+	case b.started <- struct{}{}:
+		process, err := b.start()
+		if err != nil {
+			<-b.started
+			return nil, err
+		}
+		return process, nil
+	}
+}
+
+// release makes the helper available for the next request, unless the request
+// failed in a way that leaves the helper in an unknown state, or the backend
+// was closed.
+func (b *CommandBackend) release(process *commandProcess, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var requestErr *commandRequestError
+	if b.closed || (err != nil && !errors.As(err, &requestErr)) {
+		process.close()
+		<-b.started
+		return
+	}
+	b.idle <- process
+}
+
+// Close terminates the idle helpers, and the busy helpers once their current
+// request completes. No new requests are accepted afterwards.
+func (b *CommandBackend) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for {
+		select {
+		case process := <-b.idle:
+			process.close()
+			<-b.started
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends the request to an idle helper, and returns its complete message.
+// Other messages are passed to the callback.
+func (b *CommandBackend) do(request interface{}, callback func(response *commandResponse) error) (*commandResponse, error) {
+	process, err := b.acquire()
+	if err != nil {
+		return nil, err
+	}
+	response, err := process.request(request, callback)
+	b.release(process, err)
+	return response, err
+}
+
+func (p *commandProcess) request(request interface{}, callback func(response *commandResponse) error) (*commandResponse, error) {
+	if err := json.NewEncoder(p.stdin).Encode(request); err != nil {
+		return nil, fmt.Errorf("failed to send request to cache helper: %v", err)
+	}
+
+	// Messages are read until the complete message, even if the callback
+	// fails, such that the next request does not read them.
+	var callbackErr error
+	for {
+		line, err := p.stdout.ReadBytes('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response of cache helper: %v", err)
+		}
+		var response commandResponse
+		if err := json.Unmarshal(line, &response); err != nil {
+			return nil, fmt.Errorf("invalid response of cache helper: %v", err)
+		}
+		if response.Event != "complete" {
+			if callback != nil && callbackErr == nil {
+				callbackErr = callback(&response)
+			}
+			continue
+		}
+		if response.Error != nil {
+			return nil, &commandRequestError{message: response.Error.Message}
+		}
+		if callbackErr != nil {
+			return nil, &commandRequestError{message: callbackErr.Error()}
+		}
+		return &response, nil
+	}
+}
+
+// close asks the helper to terminate, and waits for it to exit.
+func (p *commandProcess) close() {
+	json.NewEncoder(p.stdin).Encode(&commandRequest{Event: "terminate"})
+	p.stdin.Close()
+	p.cmd.Wait()
+}
+
+func (b *CommandBackend) Exists(oid string, size int64) (bool, error) {
+	response, err := b.do(&commandObjectRequest{Event: "exists", Oid: oid, Size: size}, nil)
+	if err != nil {
+		return false, err
+	}
+	return response.Found, nil
+}
+
+func (b *CommandBackend) Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	response, err := b.do(&commandObjectRequest{Event: "get", Oid: oid, Size: size, Path: dest}, func(response *commandResponse) error {
+		if response.Event == "progress" && progressCallback != nil {
+			progressCallback(response.BytesSoFar, response.BytesSinceLast)
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(dest)
+		return false, fmt.Errorf("failed to download object: %v", err)
+	}
+	if !response.Found {
+		os.Remove(dest)
+		return false, nil
+	}
+
+	// Verify that the contents of the file match the OID
+	file, err := os.Open(dest)
+	if err != nil {
+		return false, fmt.Errorf("failed to open downloaded object: %v", err)
+	}
+	defer file.Close()
+	if err := verifyFile(file, oid, size); err != nil {
+		file.Close()
+		os.Remove(dest)
+		if !errors.Is(err, ErrInvalidObject) {
+			return false, err
+		}
+		return false, removeCorruptObject(b, b.configuration.writable(), oid, size, err, b.verifyStored)
+	}
+
+	return true, nil
+}
+
+// verifyStored lets the helper get the object once more, into a temporary
+// file, and checks whether it matches its OID.
+func (b *CommandBackend) verifyStored(oid string, size int64) error {
+	file, err := os.CreateTemp("", "lfs-cache-verify-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	response, err := b.do(&commandObjectRequest{Event: "get", Oid: oid, Size: size, Path: file.Name()}, nil)
+	if err != nil {
+		return err
+	}
+	if !response.Found {
+		return errors.New("object is no longer in the cache")
+	}
+	file, err = os.Open(file.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return verifyFile(file, oid, size)
+}
+
+func (b *CommandBackend) Upload(source string, oid string, size int64) (bool, error) {
+	uploaded, err := b.Exists(oid, size)
+	if uploaded && err == nil {
+		return false, nil
+	}
+
+	// Make sure that the cache is never poisoned with objects that do not
+	// match their OID
+	file, err := os.Open(source)
+	if err != nil {
+		return false, fmt.Errorf("failed to open source file: %v", err)
+	}
+	err = verifyFile(file, oid, size)
+	file.Close()
+	if err != nil {
+		return false, err
+	}
+
+	response, err := b.do(&commandObjectRequest{Event: "put", Oid: oid, Size: size, Path: source}, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to upload object: %v", err)
+	}
+	return response.Stored, nil
+}
+
+func (b *CommandBackend) Delete(oid string) error {
+	if _, err := b.do(&commandObjectRequest{Event: "delete", Oid: oid}, nil); err != nil {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	return nil
+}
+
+func (b *CommandBackend) List(callback func(object *Object) error) error {
+	var callbackErr error
+	_, err := b.do(&commandRequest{Event: "list"}, func(response *commandResponse) error {
+		if response.Event != "object" || !oidPattern.MatchString(response.Oid) {
+			return nil
+		}
+		callbackErr = callback(&Object{
+			Oid:          response.Oid,
+			Size:         response.Size,
+			LastModified: response.LastModified,
+			StorageClass: response.StorageClass,
+		})
+		return callbackErr
+	})
+	if callbackErr != nil {
+		return callbackErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %v", err)
+	}
+	return nil
+}
@@ -5,30 +5,109 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go/logging"
 	"github.com/git-lfs/git-lfs/v3/config"
+	"github.com/git-lfs/git-lfs/v3/creds"
+)
+
+const (
+	backendAzure      = "azure"
+	backendCommand    = "command:"
+	backendFilesystem = "filesystem"
+	backendGCS        = "gcs"
+	backendHTTP       = "http"
+	backendS3         = "s3"
+
+	// daemonSocketName is the name of the socket of the shared daemon in the
+	// runtime directory of the user.
+	daemonSocketName = "git-lfs-s3-caching-adapter.sock"
+
+	modeCacheOnly   = "cache-only"
+	modePullThrough = "pull-through"
+
+	// modeEnvironmentVariable overrides the configured mode, e.g. for build
+	// agents that must not download from upstream.
+	modeEnvironmentVariable = "LFSCACHE_MODE"
+
+	defaultBatchSize    = 100
+	defaultBatchWindow  = 100 * time.Millisecond
+	defaultDrainTimeout = 10 * time.Minute
+	defaultProbeTTL     = time.Hour
+
+	defaultDownloadConcurrency  = 4
+	defaultDownloadPartSize     = 8 * 1024 * 1024
+	defaultLocalCacheSize       = 10 * 1024 * 1024 * 1024
+	defaultMultipartConcurrency = 4
+	defaultMultipartPartSize    = 8 * 1024 * 1024
+	defaultMultipartThreshold   = 64 * 1024 * 1024
+	minimumMultipartPartSize    = 5 * 1024 * 1024
 )
 
 type cachingConfiguration struct {
-	Bucket             *string  `json:"bucket,omitempty"`
-	ConfigurationFiles []string `json:"configurationFiles,omitempty"`
-	CredentialsFiles   []string `json:"credentialsFiles,omitempty"`
-	Endpoint           *string  `json:"endpoint,omitempty"`
-	Prefix             *string  `json:"prefix,omitempty"`
-	Profile            *string  `json:"profile,omitempty"`
-	Region             *string  `json:"region,omitempty"`
-	Scope              *string  `json:"scope,omitempty"`
-	UsePathStyle       *bool    `json:"usePathStyle,omitempty"`
+	Account              *string                 `json:"account,omitempty"`
+	AccountKey           *string                 `json:"accountKey,omitempty"`
+	Backend              *string                 `json:"backend,omitempty"`
+	BatchSize            *int                    `json:"batchSize,omitempty"`
+	BatchWindow          *string                 `json:"batchWindow,omitempty"`
+	Bucket               *string                 `json:"bucket,omitempty"`
+	CABundle             *string                 `json:"caBundle,omitempty"`
+	Concurrency          *int                    `json:"concurrency,omitempty"`
+	ConfigurationFiles   []string                `json:"configurationFiles,omitempty"`
+	Container            *string                 `json:"container,omitempty"`
+	CredentialsFiles     []string                `json:"credentialsFiles,omitempty"`
+	DaemonSocket         *string                 `json:"daemonSocket,omitempty"`
+	DownloadConcurrency  *int                    `json:"downloadConcurrency,omitempty"`
+	DownloadPartSize     *int                    `json:"downloadPartSize,omitempty"`
+	DrainTimeout         *string                 `json:"drainTimeout,omitempty"`
+	Endpoint             *string                 `json:"endpoint,omitempty"`
+	LocalCachePath       *string                 `json:"localCachePath,omitempty"`
+	LocalCacheSize       *int                    `json:"localCacheSize,omitempty"`
+	LockPath             *string                 `json:"lockPath,omitempty"`
+	Mode                 *string                 `json:"mode,omitempty"`
+	MultipartConcurrency *int                    `json:"multipartConcurrency,omitempty"`
+	MultipartPartSize    *int                    `json:"multipartPartSize,omitempty"`
+	MultipartThreshold   *int                    `json:"multipartThreshold,omitempty"`
+	Name                 *string                 `json:"name,omitempty"`
+	Path                 *string                 `json:"path,omitempty"`
+	Prefix               *string                 `json:"prefix,omitempty"`
+	ProbeTTL             *string                 `json:"probeTTL,omitempty"`
+	Profile              *string                 `json:"profile,omitempty"`
+	RecordAccess         *bool                   `json:"recordAccess,omitempty"`
+	Region               *string                 `json:"region,omitempty"`
+	SasToken             *string                 `json:"sasToken,omitempty"`
+	Scope                *string                 `json:"scope,omitempty"`
+	ServiceAccountFile   *string                 `json:"serviceAccountFile,omitempty"`
+	StreamToCache        *bool                   `json:"streamToCache,omitempty"`
+	Targets              []*cachingConfiguration `json:"targets,omitempty"`
+	UsePathStyle         *bool                   `json:"usePathStyle,omitempty"`
+	Write                *bool                   `json:"write,omitempty"`
+
+	// credentials fills credentials for cache backends using the Git
+	// credential helpers.
+	credentials *creds.CredentialHelperContext
+
+	// storageDir is the LFS storage directory of the repository, if any.
+	storageDir string
 }
 
 func GetCachingConfiguration(cfg *config.Configuration) *cachingConfiguration {
 	workingDir := cfg.LocalWorkingDir()
 
-	cachingConfiguration := &cachingConfiguration{}
+	cachingConfiguration := &cachingConfiguration{
+		credentials: creds.NewCredentialHelperContext(cfg.Git, cfg.Os),
+	}
+	if cfg.InRepo() {
+		cachingConfiguration.storageDir = cfg.LFSStorageDir()
+	}
 	_, err := os.Stat(workingDir + "/.lfscaching.json")
 	if err == nil {
 		file, err := os.Open(workingDir + "/.lfscaching.json")
@@ -44,6 +123,10 @@ func GetCachingConfiguration(cfg *config.Configuration) *cachingConfiguration {
 		fmt.Fprintf(os.Stderr, "Error while checking existance of .lfsconfig.json. Will ignore its values\n")
 	}
 
+	if value, ok := os.LookupEnv(modeEnvironmentVariable); ok && value != "" {
+		cachingConfiguration.Mode = &value
+	}
+
 	if cachingConfiguration.Scope == nil {
 		if value, ok := cfg.Git.Get("lfscache.scope"); ok {
 			cachingConfiguration.Scope = &value
@@ -56,52 +139,516 @@ func GetCachingConfiguration(cfg *config.Configuration) *cachingConfiguration {
 	}
 	for _, scope := range scopes {
 		fmt.Fprintf(os.Stderr, "Reading additional configuration values from gitconfig in scope 'lfscache%s'\n", scope)
-		if cachingConfiguration.Bucket == nil {
-			if value, ok := cfg.Git.Get(fmt.Sprintf("lfscache%s.bucket", scope)); ok {
-				cachingConfiguration.Bucket = &value
-			}
+		cachingConfiguration.readGitConfiguration(cfg, fmt.Sprintf("lfscache%s", scope))
+	}
+
+	if cachingConfiguration.Targets == nil {
+		cachingConfiguration.Targets = readTargets(cfg, scopes)
+	}
+	for i, target := range cachingConfiguration.Targets {
+		target.inherit(cachingConfiguration)
+		target.credentials = cachingConfiguration.credentials
+		if target.Name == nil {
+			name := fmt.Sprintf("target-%d", i+1)
+			target.Name = &name
 		}
-		if cachingConfiguration.ConfigurationFiles == nil {
-			if values := cfg.Git.GetAll(fmt.Sprintf("lfscache%s.configFile", scope)); len(values) > 0 {
-				cachingConfiguration.ConfigurationFiles = append(cachingConfiguration.ConfigurationFiles, values...)
-			}
+	}
+
+	return cachingConfiguration
+}
+
+// DecodeCachingConfiguration decodes a configuration that was resolved by
+// GetCachingConfiguration in another process, such as an adapter forwarding to
+// the shared daemon. Credentials are filled using the Git configuration of this
+// process.
+func DecodeCachingConfiguration(cfg *config.Configuration, data []byte, storageDir string) (*cachingConfiguration, error) {
+	cachingConfiguration := &cachingConfiguration{}
+	if err := json.Unmarshal(data, cachingConfiguration); err != nil {
+		return nil, fmt.Errorf("failed to decode caching configuration: %v", err)
+	}
+	cachingConfiguration.credentials = creds.NewCredentialHelperContext(cfg.Git, cfg.Os)
+	cachingConfiguration.storageDir = storageDir
+	for _, target := range cachingConfiguration.Targets {
+		target.credentials = cachingConfiguration.credentials
+	}
+	return cachingConfiguration, nil
+}
+
+// WithoutSecrets returns a copy of the configuration without the Azure account
+// key and SAS token, such that it can be logged or passed to the shared daemon.
+// Backends set up from the copy use the credentials of their own environment.
+func (c *cachingConfiguration) WithoutSecrets() *cachingConfiguration {
+	copied := *c
+	copied.AccountKey = nil
+	copied.SasToken = nil
+	copied.Targets = nil
+	for _, target := range c.Targets {
+		copied.Targets = append(copied.Targets, target.WithoutSecrets())
+	}
+	return &copied
+}
+
+// readTargets reads the cache targets listed in the first scope that lists any.
+// The configuration of each target is read from its own scope.
+func readTargets(cfg *config.Configuration, scopes []string) []*cachingConfiguration {
+	var targets []*cachingConfiguration
+	for _, scope := range scopes {
+		for _, name := range cfg.Git.GetAll(fmt.Sprintf("lfscache%s.target", scope)) {
+			fmt.Fprintf(os.Stderr, "Reading configuration of cache target '%s' from gitconfig in scope 'lfscache.%s'\n", name, name)
+			target := &cachingConfiguration{Name: &name}
+			target.readGitConfiguration(cfg, fmt.Sprintf("lfscache.%s", name))
+			targets = append(targets, target)
 		}
-		if cachingConfiguration.CredentialsFiles == nil {
-			if values := cfg.Git.GetAll(fmt.Sprintf("lfscache%s.credentialsFile", scope)); len(values) > 0 {
-				cachingConfiguration.CredentialsFiles = append(cachingConfiguration.CredentialsFiles, values...)
-			}
+		if targets != nil {
+			break
 		}
-		if cachingConfiguration.Endpoint == nil {
-			if value, ok := cfg.Git.Get(fmt.Sprintf("lfscache%s.endpoint", scope)); ok {
-				cachingConfiguration.Endpoint = &value
-			}
+	}
+	return targets
+}
+
+// readGitConfiguration reads the configuration values from the given section of
+// the Git configuration, unless they were set by a more preferred configuration
+// source already.
+func (c *cachingConfiguration) readGitConfiguration(cfg *config.Configuration, section string) {
+	if c.Account == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.account", section)); ok {
+			c.Account = &value
 		}
-		if cachingConfiguration.Prefix == nil {
-			if value, ok := cfg.Git.Get(fmt.Sprintf("lfscache%s.prefix", scope)); ok {
-				cachingConfiguration.Prefix = &value
-			}
+	}
+	if c.AccountKey == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.accountKey", section)); ok {
+			c.AccountKey = &value
 		}
-		if cachingConfiguration.Profile == nil {
-			if value, ok := cfg.Git.Get(fmt.Sprintf("lfscache%s.profile", scope)); ok {
-				cachingConfiguration.Profile = &value
-			}
+	}
+	if c.Backend == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.backend", section)); ok {
+			c.Backend = &value
 		}
-		if cachingConfiguration.Region == nil {
-			if value, ok := cfg.Git.Get(fmt.Sprintf("lfscache%s.region", scope)); ok {
-				cachingConfiguration.Region = &value
-			}
+	}
+	readInt(cfg, fmt.Sprintf("%s.batchSize", section), &c.BatchSize)
+	if c.BatchWindow == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.batchWindow", section)); ok {
+			c.BatchWindow = &value
 		}
-		if cachingConfiguration.UsePathStyle == nil {
-			usePathStyle := cfg.Git.Bool(fmt.Sprintf("lfscache%s.usePathStyle", scope), false)
-			cachingConfiguration.UsePathStyle = &usePathStyle
+	}
+	if c.Bucket == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.bucket", section)); ok {
+			c.Bucket = &value
 		}
 	}
+	if c.CABundle == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.caBundle", section)); ok {
+			c.CABundle = &value
+		}
+	}
+	readInt(cfg, fmt.Sprintf("%s.concurrency", section), &c.Concurrency)
+	if c.ConfigurationFiles == nil {
+		if values := cfg.Git.GetAll(fmt.Sprintf("%s.configFile", section)); len(values) > 0 {
+			c.ConfigurationFiles = append(c.ConfigurationFiles, values...)
+		}
+	}
+	if c.Container == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.container", section)); ok {
+			c.Container = &value
+		}
+	}
+	if c.CredentialsFiles == nil {
+		if values := cfg.Git.GetAll(fmt.Sprintf("%s.credentialsFile", section)); len(values) > 0 {
+			c.CredentialsFiles = append(c.CredentialsFiles, values...)
+		}
+	}
+	if c.DaemonSocket == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.daemonSocket", section)); ok {
+			c.DaemonSocket = &value
+		}
+	}
+	readInt(cfg, fmt.Sprintf("%s.downloadConcurrency", section), &c.DownloadConcurrency)
+	readInt(cfg, fmt.Sprintf("%s.downloadPartSize", section), &c.DownloadPartSize)
+	if c.DrainTimeout == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.drainTimeout", section)); ok {
+			c.DrainTimeout = &value
+		}
+	}
+	if c.Endpoint == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.endpoint", section)); ok {
+			c.Endpoint = &value
+		}
+	}
+	if c.LocalCachePath == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.localCachePath", section)); ok {
+			c.LocalCachePath = &value
+		}
+	}
+	readInt(cfg, fmt.Sprintf("%s.localCacheSize", section), &c.LocalCacheSize)
+	if c.LockPath == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.lockPath", section)); ok {
+			c.LockPath = &value
+		}
+	}
+	if c.Mode == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.mode", section)); ok {
+			c.Mode = &value
+		}
+	}
+	readInt(cfg, fmt.Sprintf("%s.multipartConcurrency", section), &c.MultipartConcurrency)
+	readInt(cfg, fmt.Sprintf("%s.multipartPartSize", section), &c.MultipartPartSize)
+	readInt(cfg, fmt.Sprintf("%s.multipartThreshold", section), &c.MultipartThreshold)
+	if c.Path == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.path", section)); ok {
+			c.Path = &value
+		}
+	}
+	if c.Prefix == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.prefix", section)); ok {
+			c.Prefix = &value
+		}
+	}
+	if c.ProbeTTL == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.probeTTL", section)); ok {
+			c.ProbeTTL = &value
+		}
+	}
+	if c.Profile == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.profile", section)); ok {
+			c.Profile = &value
+		}
+	}
+	readBool(cfg, fmt.Sprintf("%s.recordAccess", section), &c.RecordAccess)
+	if c.Region == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.region", section)); ok {
+			c.Region = &value
+		}
+	}
+	if c.SasToken == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.sasToken", section)); ok {
+			c.SasToken = &value
+		}
+	}
+	if c.ServiceAccountFile == nil {
+		if value, ok := cfg.Git.Get(fmt.Sprintf("%s.serviceAccountFile", section)); ok {
+			c.ServiceAccountFile = &value
+		}
+	}
+	readBool(cfg, fmt.Sprintf("%s.streamToCache", section), &c.StreamToCache)
+	readBool(cfg, fmt.Sprintf("%s.usePathStyle", section), &c.UsePathStyle)
+	readBool(cfg, fmt.Sprintf("%s.write", section), &c.Write)
+}
 
-	return cachingConfiguration
+// inherit copies the values that are not set in this configuration from the
+// parent configuration, such that cache targets only need to configure what
+// differs between them.
+func (c *cachingConfiguration) inherit(parent *cachingConfiguration) {
+	target := reflect.ValueOf(c).Elem()
+	source := reflect.ValueOf(parent).Elem()
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		switch field.Name {
+		case "Name", "Targets", "Write":
+			continue
+		}
+		if target.Field(i).IsNil() {
+			target.Field(i).Set(source.Field(i))
+		}
+	}
 }
 
 func (c *cachingConfiguration) enabled() bool {
-	return c.Bucket != nil
+	if len(c.Targets) > 0 {
+		return true
+	}
+	switch c.backend() {
+	case backendAzure:
+		return c.Container != nil
+	case backendFilesystem:
+		return c.Path != nil
+	case backendGCS:
+		return c.Bucket != nil
+	case backendHTTP:
+		return c.Endpoint != nil
+	case backendS3:
+		return c.Bucket != nil
+	default:
+		return true
+	}
+}
+
+// name returns the name of a cache target.
+func (c *cachingConfiguration) name() string {
+	if c.Name == nil {
+		return ""
+	}
+	return *c.Name
+}
+
+// keyPrefix returns the prefix of the keys of the objects in the cache,
+// including the trailing slash, or an empty string if no prefix is configured.
+func (c *cachingConfiguration) keyPrefix() string {
+	if c.Prefix == nil || *c.Prefix == "" {
+		return ""
+	}
+	return *c.Prefix + "/"
+}
+
+// writable returns whether objects are added to a cache target.
+func (c *cachingConfiguration) writable() bool {
+	return c.Write == nil || *c.Write
+}
+
+// backend returns the name of the configured cache backend.
+func (c *cachingConfiguration) backend() string {
+	if c.Backend == nil || *c.Backend == "" {
+		return backendS3
+	}
+	return *c.Backend
+}
+
+// ConcurrentTransfers returns the number of transfers a single adapter session
+// is allowed to have in flight at the same time.
+func (c *cachingConfiguration) ConcurrentTransfers() int {
+	if c.Concurrency == nil || *c.Concurrency < 1 {
+		return 1
+	}
+	return *c.Concurrency
+}
+
+// UpstreamBatchSize returns the maximum number of objects for which transfer
+// actions are requested from the upstream LFS API in a single batch request.
+func (c *cachingConfiguration) UpstreamBatchSize() int {
+	if c.BatchSize == nil || *c.BatchSize < 1 {
+		return defaultBatchSize
+	}
+	return *c.BatchSize
+}
+
+// UpstreamBatchWindow returns how long upstream transfers are collected before
+// a batch request is sent, if the batch did not fill up before.
+func (c *cachingConfiguration) UpstreamBatchWindow() time.Duration {
+	if c.BatchWindow == nil {
+		return defaultBatchWindow
+	}
+	window, err := time.ParseDuration(*c.BatchWindow)
+	if err != nil || window < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid batch window %q, using %s instead\n", *c.BatchWindow, defaultBatchWindow)
+		return defaultBatchWindow
+	}
+	return window
+}
+
+// CacheDrainTimeout returns how long a session waits for objects that are still
+// being added to the cache in the background, once Git LFS asks it to terminate.
+func (c *cachingConfiguration) CacheDrainTimeout() time.Duration {
+	if c.DrainTimeout == nil {
+		return defaultDrainTimeout
+	}
+	timeout, err := time.ParseDuration(*c.DrainTimeout)
+	if err != nil || timeout < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid drain timeout %q, using %s instead\n", *c.DrainTimeout, defaultDrainTimeout)
+		return defaultDrainTimeout
+	}
+	return timeout
+}
+
+// TargetProbeTTL returns how long the results of probing the cache targets are
+// reused by later sessions. Zero disables probing.
+func (c *cachingConfiguration) TargetProbeTTL() time.Duration {
+	if c.ProbeTTL == nil {
+		return defaultProbeTTL
+	}
+	ttl, err := time.ParseDuration(*c.ProbeTTL)
+	if err != nil || ttl < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid probe TTL %q, using %s instead\n", *c.ProbeTTL, defaultProbeTTL)
+		return defaultProbeTTL
+	}
+	return ttl
+}
+
+// CacheOnly returns whether downloads must be served from the cache, without
+// falling back to the upstream LFS server on a cache miss.
+func (c *cachingConfiguration) CacheOnly() bool {
+	if c.Mode == nil {
+		return false
+	}
+	switch *c.Mode {
+	case modeCacheOnly:
+		return true
+	case modePullThrough:
+		return false
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid mode %q, using %s instead\n", *c.Mode, modePullThrough)
+		return false
+	}
+}
+
+// DownloadRangeConcurrency returns the number of ranges of a single object that
+// are downloaded from the cache at the same time.
+func (c *cachingConfiguration) DownloadRangeConcurrency() int {
+	if c.DownloadConcurrency == nil || *c.DownloadConcurrency < 1 {
+		return defaultDownloadConcurrency
+	}
+	return *c.DownloadConcurrency
+}
+
+// DownloadRangeSize returns the size of the ranges that objects are downloaded
+// from the cache in.
+func (c *cachingConfiguration) DownloadRangeSize() int64 {
+	if c.DownloadPartSize == nil || *c.DownloadPartSize < 1 {
+		return defaultDownloadPartSize
+	}
+	return int64(*c.DownloadPartSize)
+}
+
+// LocalCacheDirectory returns the directory of the local cache, or an empty
+// string if the local cache is disabled. A leading ~ refers to the home
+// directory of the user.
+func (c *cachingConfiguration) LocalCacheDirectory() (string, error) {
+	if c.LocalCachePath == nil || *c.LocalCachePath == "" {
+		return "", nil
+	}
+	path, err := expandHome(*c.LocalCachePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve local cache path: %v", err)
+	}
+	return path, nil
+}
+
+// LockDirectory returns the directory of the lock files that make sure only
+// one process on the host downloads an object from upstream at a time, or an
+// empty string if locking is disabled. By default, the directory is in the
+// cache directory of the user. A leading ~ refers to the home directory of the
+// user.
+func (c *cachingConfiguration) LockDirectory() (string, error) {
+	if c.LockPath == nil {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve lock path: %v", err)
+		}
+		return filepath.Join(cacheDir, "git-lfs-s3-caching-adapter", "locks"), nil
+	}
+	if *c.LockPath == "" {
+		return "", nil
+	}
+	path, err := expandHome(*c.LockPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve lock path: %v", err)
+	}
+	return path, nil
+}
+
+// DaemonSocketPath returns the path of the unix socket of the shared daemon. By
+// default, the socket is in the runtime directory of the user, or in the cache
+// directory of the user if there is no runtime directory.
+func (c *cachingConfiguration) DaemonSocketPath() string {
+	if c.DaemonSocket != nil && *c.DaemonSocket != "" {
+		return *c.DaemonSocket
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, daemonSocketName)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), daemonSocketName)
+	}
+	return filepath.Join(cacheDir, "git-lfs-s3-caching-adapter", "daemon.sock")
+}
+
+// LocalCacheBudget returns the size in bytes the local cache is allowed to grow
+// to, before the least recently used objects are evicted.
+func (c *cachingConfiguration) LocalCacheBudget() int64 {
+	if c.LocalCacheSize == nil || *c.LocalCacheSize < 0 {
+		return defaultLocalCacheSize
+	}
+	return int64(*c.LocalCacheSize)
+}
+
+// MultipartUploadConcurrency returns the number of parts of a single multipart
+// upload that are uploaded at the same time.
+func (c *cachingConfiguration) MultipartUploadConcurrency() int {
+	if c.MultipartConcurrency == nil || *c.MultipartConcurrency < 1 {
+		return defaultMultipartConcurrency
+	}
+	return *c.MultipartConcurrency
+}
+
+// MultipartUploadPartSize returns the size of the parts of a multipart upload.
+// S3 requires parts to be at least 5 MiB.
+func (c *cachingConfiguration) MultipartUploadPartSize() int64 {
+	if c.MultipartPartSize == nil {
+		return defaultMultipartPartSize
+	}
+	if *c.MultipartPartSize < minimumMultipartPartSize {
+		fmt.Fprintf(os.Stderr, "Multipart part size %d is too small, using %d instead\n", *c.MultipartPartSize, minimumMultipartPartSize)
+		return minimumMultipartPartSize
+	}
+	return int64(*c.MultipartPartSize)
+}
+
+// MultipartUploadThreshold returns the size from which files are uploaded to
+// the cache using a multipart upload.
+func (c *cachingConfiguration) MultipartUploadThreshold() int64 {
+	if c.MultipartThreshold == nil || *c.MultipartThreshold < 0 {
+		return defaultMultipartThreshold
+	}
+	return int64(*c.MultipartThreshold)
+}
+
+// RecordsAccess returns whether the objects read from a writable cache are
+// recorded in access logs, such that garbage collection can remove the least
+// recently used objects.
+func (c *cachingConfiguration) RecordsAccess() bool {
+	return (c.RecordAccess == nil || *c.RecordAccess) && c.writable()
+}
+
+// StreamsToCache returns whether objects downloaded from upstream are uploaded
+// to the cache while they are downloaded, instead of afterwards.
+func (c *cachingConfiguration) StreamsToCache() bool {
+	return c.StreamToCache != nil && *c.StreamToCache
+}
+
+// expandHome replaces a leading ~ in the path by the home directory of the
+// user.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// readInt reads an integer value from the Git configuration into target, unless
+// target was already set by a more preferred configuration source.
+func readInt(cfg *config.Configuration, key string, target **int) {
+	if *target != nil {
+		return
+	}
+	value, ok := cfg.Git.Get(key)
+	if !ok {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid integer value %q for %s. Will ignore its value\n", value, key)
+		return
+	}
+	*target = &parsed
+}
+
+// readBool reads a boolean value from the Git configuration into target, unless
+// target was already set by a more preferred configuration source.
+func readBool(cfg *config.Configuration, key string, target **bool) {
+	if *target != nil {
+		return
+	}
+	if _, ok := cfg.Git.Get(key); !ok {
+		return
+	}
+	value := cfg.Git.Bool(key, false)
+	*target = &value
 }
 
 func (c *cachingConfiguration) newClient() (*s3.Client, error) {
@@ -118,6 +665,9 @@ func (c *cachingConfiguration) newClient() (*s3.Client, error) {
 	if c.Profile != nil {
 		opts = append(opts, awsconfig.WithSharedConfigProfile(*c.Profile))
 	}
+	if c.Region != nil {
+		opts = append(opts, awsconfig.WithRegion(*c.Region))
+	}
 
 	config, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
 	if err != nil {
@@ -128,6 +678,6 @@ func (c *cachingConfiguration) newClient() (*s3.Client, error) {
 		if c.Endpoint != nil {
 			o.BaseEndpoint = c.Endpoint
 		}
-		o.UsePathStyle = *c.UsePathStyle
+		o.UsePathStyle = aws.ToBool(c.UsePathStyle)
 	}), nil
 }
@@ -0,0 +1,173 @@
+package caching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// downloadProgress combines the progress of the ranges of a single download.
+type downloadProgress struct {
+	bytesSoFar       int64
+	mutex            sync.Mutex
+	progressCallback func(bytesSoFar int64, bytesSinceLast int64)
+}
+
+// reset starts counting from zero again, when the download starts over.
+func (p *downloadProgress) reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.bytesSoFar = 0
+}
+
+func (p *downloadProgress) add(bytesSinceLast int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.bytesSoFar += bytesSinceLast
+	if p.progressCallback != nil {
+		p.progressCallback(p.bytesSoFar, bytesSinceLast)
+	}
+}
+
+// errRangesNotSupported is returned by a rangeOpener if the server did not
+// respond with the requested range, e.g. because it ignores range requests.
+var errRangesNotSupported = errors.New("server does not support range requests")
+
+// checkContentRange checks whether the Content-Range of a response matches the
+// requested range of an object of the given size. Servers that ignore range
+// requests respond without a Content-Range, which is only fine if the entire
+// object was requested.
+func checkContentRange(contentRange string, offset int64, end int64, size int64) error {
+	if contentRange == "" && offset == 0 && end == size {
+		return nil
+	}
+	if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-%d/", offset, end-1)) {
+		return fmt.Errorf("%w: requested bytes %d-%d, got range %q", errRangesNotSupported, offset, end-1, contentRange)
+	}
+	return nil
+}
+
+// rangeOpener opens the bytes of an object from offset up to end for reading.
+type rangeOpener func(offset int64, end int64) (io.ReadCloser, error)
+
+// downloadRanges downloads the object into the file, which must be allocated to
+// the size of the object already. The object is split into ranges of the given
+// size, which are downloaded in parallel. If the server does not respond with
+// the requested ranges, the object is downloaded in a single request instead.
+func downloadRanges(file *os.File, oid string, size int64, concurrency int, rangeSize int64, progress *downloadProgress, open rangeOpener) error {
+	var mutex sync.Mutex
+	var firstErr error
+	var ranges sync.WaitGroup
+	inFlight := make(chan struct{}, concurrency)
+	for offset := int64(0); offset < size; offset += rangeSize {
+		inFlight <- struct{}{}
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed {
+			<-inFlight
+			break
+		}
+
+		ranges.Add(1)
+		go func(offset int64, end int64) {
+			defer func() {
+				<-inFlight
+				ranges.Done()
+			}()
+			if err := downloadRange(file, oid, offset, end, progress, open); err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}(offset, min(offset+rangeSize, size))
+	}
+	ranges.Wait()
+
+	if errors.Is(firstErr, errRangesNotSupported) && rangeSize < size {
+		fmt.Fprintf(os.Stderr, "Downloading object %s from cache in a single request instead, %s\n", oid, firstErr.Error())
+		progress.reset()
+		return downloadRanges(file, oid, size, 1, size, progress, open)
+	}
+	return firstErr
+}
+
+// downloadRange downloads the bytes of the object from offset up to end into
+// the same location of the file. When the transfer fails, it is retried from
+// the last byte that was written, within this download only. It only gives up
+// after a few attempts in a row did not make any progress, or right away if the
+// server does not respond with the requested range.
+func downloadRange(file *os.File, oid string, offset int64, end int64, progress *downloadProgress, open rangeOpener) error {
+	for failures := 0; ; {
+		written, err := getRange(file, offset, end, progress, open)
+		offset += written
+		if err == nil || offset >= end {
+			return nil
+		}
+		if errors.Is(err, errRangesNotSupported) {
+			return err
+		}
+
+		if written > 0 {
+			failures = 0
+		}
+		failures++
+		if failures >= partAttempts {
+			return fmt.Errorf("failed to download object: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Retrying download of object %s from cache at offset %d: %s\n", oid, offset, err.Error())
+		time.Sleep(time.Duration(failures) * time.Second)
+	}
+}
+
+func getRange(file *os.File, offset int64, end int64, progress *downloadProgress, open rangeOpener) (int64, error) {
+	body, err := open(offset, end)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	written, err := io.Copy(io.NewOffsetWriter(file, offset), &progressReader{
+		reader: io.LimitReader(body, end-offset),
+		progressCallback: func(bytesSoFar int64, bytesSinceLast int64) {
+			progress.add(bytesSinceLast)
+		},
+	})
+	if err == nil && written < end-offset {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
+
+// rangeOpener returns a function that opens ranges of the object in the bucket.
+func (a *S3CachingAdapter) rangeOpener(oid string, size int64) rangeOpener {
+	return func(offset int64, end int64) (io.ReadCloser, error) {
+		// The contents are verified against the OID once the object is
+		// complete, which makes the checksum validation of the SDK redundant.
+		resp, err := a.client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: a.configuration.Bucket,
+			Key:    a.key(oid),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		}, func(o *s3.Options) {
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := checkContentRange(aws.ToString(resp.ContentRange), offset, end, size); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+}
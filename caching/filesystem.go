@@ -0,0 +1,217 @@
+package caching
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var oidPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+var _ StreamingBackend = (*FilesystemBackend)(nil)
+
+// FilesystemBackend stores the cache in a directory, e.g. on a shared network
+// mount. Objects are laid out like in .git/lfs/objects, below the configured
+// prefix if any.
+type FilesystemBackend struct {
+	readOnly bool
+	root     string
+}
+
+func NewFilesystemBackend(configuration *cachingConfiguration) (*FilesystemBackend, error) {
+	if configuration.Path == nil {
+		return nil, errors.New("no path configured for the filesystem cache backend")
+	}
+	root := *configuration.Path
+	if configuration.Prefix != nil {
+		root = filepath.Join(root, *configuration.Prefix)
+	}
+	fmt.Fprintf(os.Stderr, "Using filesystem cache backend in %s\n", root)
+	return newFilesystemBackend(root, !configuration.writable())
+}
+
+func newFilesystemBackend(root string, readOnly bool) (*FilesystemBackend, error) {
+	backend := &FilesystemBackend{readOnly: readOnly, root: root}
+	if err := backend.checkPermissions(); err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// checkPermissions makes sure that objects can be both read from and written to
+// the cache, such that problems show up right away instead of on every object.
+// Read-only caches, e.g. on a read-only mount, only have to be readable.
+func (b *FilesystemBackend) checkPermissions() error {
+	if b.readOnly {
+		if _, err := os.ReadDir(b.root); err != nil {
+			return fmt.Errorf("cache directory is not readable: %v", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(b.root, 0777); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	if _, err := os.ReadDir(b.root); err != nil {
+		return fmt.Errorf("cache directory is not readable: %v", err)
+	}
+	file, err := os.CreateTemp(b.root, ".permission-check-*")
+	if err != nil {
+		return fmt.Errorf("cache directory is not writable: %v", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func (b *FilesystemBackend) path(oid string) string {
+	return filepath.Join(b.root, oid[0:2], oid[2:4], oid)
+}
+
+func (b *FilesystemBackend) Exists(oid string, size int64) (bool, error) {
+	info, err := os.Stat(b.path(oid))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	if info.Size() != size {
+		return false, fmt.Errorf("object size mismatch: expected %d, got %d", size, info.Size())
+	}
+	return true, nil
+}
+
+func (b *FilesystemBackend) Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	if ok, err := b.Exists(oid, size); !ok {
+		return false, err
+	}
+
+	source, err := os.Open(b.path(oid))
+	if err != nil {
+		return false, fmt.Errorf("failed to open object: %v", err)
+	}
+	defer source.Close()
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return false, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, hash), &progressReader{reader: source, progressCallback: progressCallback})
+	if err != nil {
+		os.Remove(dest)
+		return false, fmt.Errorf("failed to write to file: %v", err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); written != size || actual != oid {
+		file.Close()
+		os.Remove(dest)
+		err := fmt.Errorf("%w: expected OID %s of %d bytes, got %s of %d bytes", ErrInvalidObject, oid, size, actual, written)
+		return false, removeCorruptObject(b, !b.readOnly, oid, size, err, b.verifyStored)
+	}
+
+	return true, nil
+}
+
+// verifyStored reads the stored object again, and checks whether it matches its
+// OID.
+func (b *FilesystemBackend) verifyStored(oid string, size int64) error {
+	file, err := os.Open(b.path(oid))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return verifyStream(file, oid, size)
+}
+
+func (b *FilesystemBackend) Upload(source string, oid string, size int64) (bool, error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return false, fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer file.Close()
+
+	return b.UploadStream(file, oid, size)
+}
+
+// UploadStream writes the object to a temporary file next to its final location
+// first, and only moves it in place once it is verified. This way, readers never
+// see an incomplete object, even on a shared network mount.
+func (b *FilesystemBackend) UploadStream(reader io.Reader, oid string, size int64) (bool, error) {
+	uploaded, err := b.Exists(oid, size)
+	if uploaded && err == nil {
+		return false, nil
+	}
+
+	path := b.path(oid)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return false, fmt.Errorf("failed to create directory: %v", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s-*", oid))
+	if err != nil {
+		return false, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, hash), reader)
+	if err != nil {
+		return false, fmt.Errorf("failed to write object: %v", err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); written != size || actual != oid {
+		return false, fmt.Errorf("%w: expected OID %s of %d bytes, got %s of %d bytes", ErrInvalidObject, oid, size, actual, written)
+	}
+	if err := file.Chmod(0644); err != nil {
+		return false, fmt.Errorf("failed to change permissions of object: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return false, fmt.Errorf("failed to write object: %v", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return false, fmt.Errorf("failed to move object in place: %v", err)
+	}
+
+	return true, nil
+}
+
+func (b *FilesystemBackend) Delete(oid string) error {
+	err := os.Remove(b.path(oid))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	return nil
+}
+
+func (b *FilesystemBackend) List(callback func(object *Object) error) error {
+	return filepath.WalkDir(b.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !oidPattern.MatchString(entry.Name()) {
+			return nil
+		}
+		oid := entry.Name()
+		if path != b.path(oid) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return callback(&Object{
+			Oid:          oid,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	})
+}
@@ -0,0 +1,170 @@
+package caching
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// GCPolicyModified uses the time an object was last added to the cache as
+	// the time it was last used.
+	GCPolicyModified = "modified"
+
+	// GCPolicyLRU uses the last time an object was read from the cache, as
+	// recorded in the access logs of the cache, as the time it was last used.
+	// Objects that were never read are treated as if they were read when they
+	// were added.
+	GCPolicyLRU = "lru"
+)
+
+// GCOptions select the objects that are removed from the cache by
+// CollectGarbage. Limits that are zero are not applied.
+type GCOptions struct {
+	// DryRun only reports the objects that would be removed.
+	DryRun bool
+
+	// MaxAge removes the objects that were not used for longer than this.
+	MaxAge time.Duration
+
+	// MaxSize removes the least recently used objects, until the total size
+	// of the remaining objects is at most this many bytes.
+	MaxSize int64
+
+	// Policy selects how the time an object was last used is determined,
+	// GCPolicyModified if empty.
+	Policy string
+}
+
+// GCReport describes the result of CollectGarbage.
+type GCReport struct {
+	Objects    int
+	Bytes      int64
+	Removed    []*Object
+	BytesFreed int64
+	Errors     []error
+}
+
+// GCTarget is a cache that garbage is collected in by itself.
+type GCTarget struct {
+	// Name is the name of the cache target, or empty if the cache has no
+	// targets.
+	Name    string
+	Backend Backend
+}
+
+// GCTargets returns the caches to collect garbage in one by one. Each writable
+// cache target of a MultiBackend is collected by itself, such that the limits
+// apply to every target, and objects are only removed from the target they are
+// found in. Read-only cache targets are left alone.
+func GCTargets(backend Backend) []*GCTarget {
+	multiBackend, ok := backend.(*MultiBackend)
+	if !ok {
+		return []*GCTarget{{Backend: backend}}
+	}
+	var targets []*GCTarget
+	for _, target := range multiBackend.targets {
+		if target.writable {
+			targets = append(targets, &GCTarget{Name: target.name, Backend: target.backend})
+		}
+	}
+	return targets
+}
+
+// CollectGarbage removes objects from the cache according to the options. All
+// objects are listed before any of them is removed, such that removing objects
+// does not interfere with listing the cache page by page. Objects that could not
+// be removed are reported as errors, and do not count as freed.
+//
+// With the lru policy, the access logs of the cache are compacted afterwards,
+// such that they only hold the objects that remain in the cache. If the access
+// logs cannot be read, the modified policy is used instead.
+func CollectGarbage(backend Backend, options *GCOptions, removed func(object *Object, lastUsed time.Time)) (*GCReport, error) {
+	lastUsed := func(object *Object) time.Time {
+		return object.LastModified
+	}
+	var accessLog *AccessLog
+	var accessLogBackend AccessLogBackend
+	switch options.Policy {
+	case "", GCPolicyModified:
+	case GCPolicyLRU:
+		var ok bool
+		accessLogBackend, ok = backend.(AccessLogBackend)
+		if !ok {
+			return nil, errors.New("the cache backend does not record when objects are read, which the lru policy requires")
+		}
+		var err error
+		accessLog, err = accessLogBackend.ReadAccessLog()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read access log, falling back to the %s policy. %s\n", GCPolicyModified, err.Error())
+			accessLog = nil
+			break
+		}
+		lastUsed = func(object *Object) time.Time {
+			if accessed, ok := accessLog.Accessed[object.Oid]; ok && accessed.After(object.LastModified) {
+				return accessed
+			}
+			return object.LastModified
+		}
+	default:
+		return nil, fmt.Errorf("unknown policy %q, expected %q or %q", options.Policy, GCPolicyModified, GCPolicyLRU)
+	}
+
+	report := &GCReport{}
+	var objects []*Object
+	err := backend.List(func(object *Object) error {
+		objects = append(objects, object)
+		report.Objects++
+		report.Bytes += object.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Least recently used first
+	sort.Slice(objects, func(i, j int) bool {
+		if used, otherUsed := lastUsed(objects[i]), lastUsed(objects[j]); !used.Equal(otherUsed) {
+			return used.Before(otherUsed)
+		}
+		return objects[i].Oid < objects[j].Oid
+	})
+
+	remaining := report.Bytes
+	kept := make(map[string]bool)
+	now := time.Now()
+	for _, object := range objects {
+		expired := options.MaxAge > 0 && now.Sub(lastUsed(object)) > options.MaxAge
+		overBudget := options.MaxSize > 0 && remaining > options.MaxSize
+		if !expired && !overBudget {
+			kept[object.Oid] = true
+			continue
+		}
+		if !options.DryRun {
+			if err := backend.Delete(object.Oid); err != nil {
+				report.Errors = append(report.Errors, fmt.Errorf("failed to remove object %s: %v", object.Oid, err))
+				kept[object.Oid] = true
+				continue
+			}
+		}
+		remaining -= object.Size
+		report.Removed = append(report.Removed, object)
+		report.BytesFreed += object.Size
+		if removed != nil {
+			removed(object, lastUsed(object))
+		}
+	}
+
+	// A single access log that only holds remaining objects is compact already
+	if accessLog != nil && !options.DryRun && (len(accessLog.keys) > 1 || len(accessLog.keys) == 1 && len(report.Removed) > 0) {
+		err := accessLogBackend.CompactAccessLog(accessLog, func(oid string) bool {
+			return kept[oid]
+		})
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("failed to compact access log: %v", err))
+		}
+	}
+	return report, nil
+}
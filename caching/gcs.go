@@ -0,0 +1,255 @@
+package caching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+var _ StreamingBackend = (*GCSBackend)(nil)
+
+// GCSBackend stores the cache in a Google Cloud Storage bucket, using the JSON
+// API of GCS. Objects use the same keys as in S3. Uploads larger than a single
+// part are resumable uploads, which continue where they left off when a part
+// fails.
+type GCSBackend struct {
+	bucket           *storage.BucketHandle
+	configuration    *cachingConfiguration
+	partSize         int64
+	rangeConcurrency int
+	rangeSize        int64
+}
+
+func NewGCSBackend(configuration *cachingConfiguration) (*GCSBackend, error) {
+	if configuration.Bucket == nil {
+		return nil, errors.New("no bucket configured for the GCS cache backend")
+	}
+	client, err := configuration.newGCSClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Using GCS cache backend in bucket %s\n", *configuration.Bucket)
+	return &GCSBackend{
+		bucket:           client.Bucket(*configuration.Bucket),
+		configuration:    configuration,
+		partSize:         configuration.MultipartUploadPartSize(),
+		rangeConcurrency: configuration.DownloadRangeConcurrency(),
+		rangeSize:        configuration.DownloadRangeSize(),
+	}, nil
+}
+
+// newGCSClient creates a client for the JSON API of GCS. Without a service
+// account file, the application default credentials are used, unless a custom
+// endpoint is configured. Emulators such as fake-gcs-server do not
+// authenticate requests at all.
+func (c *cachingConfiguration) newGCSClient() (*storage.Client, error) {
+	opts := []option.ClientOption{storage.WithJSONReads()}
+	if c.Endpoint != nil {
+		opts = append(opts, option.WithEndpoint(*c.Endpoint))
+	}
+	switch {
+	case c.ServiceAccountFile != nil:
+		opts = append(opts, option.WithAuthCredentialsFile(option.ServiceAccount, *c.ServiceAccountFile))
+	case c.Endpoint != nil:
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	return storage.NewClient(context.Background(), opts...)
+}
+
+func (b *GCSBackend) object(oid string) *storage.ObjectHandle {
+	return b.bucket.Object(b.configuration.keyPrefix() + oid)
+}
+
+func (b *GCSBackend) Exists(oid string, size int64) (bool, error) {
+	attrs, err := b.object(oid).Attrs(context.Background())
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	if attrs.Size != size {
+		return false, fmt.Errorf("object size mismatch: expected %d, got %d", size, attrs.Size)
+	}
+	return true, nil
+}
+
+func (b *GCSBackend) Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	if ok, err := b.Exists(oid, size); !ok {
+		return false, err
+	}
+
+	// Create the destination file, with room for the entire object
+	file, err := os.Create(dest)
+	if err != nil {
+		return false, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		os.Remove(dest)
+		return false, fmt.Errorf("failed to allocate file: %v", err)
+	}
+
+	// Download the object from the bucket, in multiple ranges at the same time
+	// if it is large enough
+	object := b.object(oid)
+	progress := &downloadProgress{progressCallback: progressCallback}
+	err = downloadRanges(file, oid, size, b.rangeConcurrency, b.rangeSize, progress, func(offset int64, end int64) (io.ReadCloser, error) {
+		return object.NewRangeReader(context.Background(), offset, end-offset)
+	})
+	if err != nil {
+		os.Remove(dest)
+		return false, err
+	}
+
+	// Verify that the contents of the file match the OID
+	if err := verifyFile(file, oid, size); err != nil {
+		file.Close()
+		os.Remove(dest)
+		if !errors.Is(err, ErrInvalidObject) {
+			return false, err
+		}
+		return false, removeCorruptObject(b, b.configuration.writable(), oid, size, err, b.verifyStored)
+	}
+
+	return true, nil
+}
+
+// verifyStored reads the object in the bucket in full, without ranges, and
+// checks whether it matches its OID.
+func (b *GCSBackend) verifyStored(oid string, size int64) error {
+	reader, err := b.object(oid).NewReader(context.Background())
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return verifyStream(reader, oid, size)
+}
+
+func (b *GCSBackend) Upload(source string, oid string, size int64) (bool, error) {
+	conditions, stored := b.uploadConditions(oid, size)
+	if stored {
+		return false, nil
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return false, fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer file.Close()
+
+	// Make sure that the cache is never poisoned with objects that do not
+	// match their OID
+	if err := verifyFile(file, oid, size); err != nil {
+		return false, err
+	}
+
+	return b.upload(file, oid, conditions)
+}
+
+// UploadStream uploads the object while it is read from the reader. The upload
+// is cancelled if the object does not match its OID, such that it never
+// becomes visible.
+func (b *GCSBackend) UploadStream(reader io.Reader, oid string, size int64) (bool, error) {
+	conditions, stored := b.uploadConditions(oid, size)
+	if stored {
+		return false, nil
+	}
+
+	return b.upload(newVerifyingReader(reader, oid, size), oid, conditions)
+}
+
+// uploadConditions returns whether the object is stored already, and the
+// conditions for uploading it otherwise. Objects are only created if they do
+// not exist yet, such that concurrent uploads of the same object do not replace
+// each other. An object of the wrong size is replaced like in S3, as long as it
+// is still the same generation.
+func (b *GCSBackend) uploadConditions(oid string, size int64) (storage.Conditions, bool) {
+	attrs, err := b.object(oid).Attrs(context.Background())
+	if err != nil {
+		return storage.Conditions{DoesNotExist: true}, false
+	}
+	if attrs.Size == size {
+		return storage.Conditions{}, true
+	}
+	fmt.Fprintf(os.Stderr, "Replacing object %s of %d bytes in cache, expected %d bytes\n", oid, attrs.Size, size)
+	return storage.Conditions{GenerationMatch: attrs.Generation}, false
+}
+
+// upload writes the object in parts of the configured size, if the conditions
+// hold. Otherwise, another upload of the object won, and the object is reported
+// as stored already.
+func (b *GCSBackend) upload(reader io.Reader, oid string, conditions storage.Conditions) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer := b.object(oid).If(conditions).NewWriter(ctx)
+	writer.ChunkSize = int(b.partSize)
+	writer.ContentType = "application/octet-stream"
+	if _, err := io.Copy(writer, reader); err != nil {
+		// Cancelling the context aborts the upload
+		cancel()
+		writer.Close()
+		if errors.Is(err, ErrInvalidObject) {
+			return false, err
+		}
+		return false, fmt.Errorf("failed to upload file to GCS: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to upload file to GCS: %v", err)
+	}
+
+	return true, nil
+}
+
+func (b *GCSBackend) Delete(oid string) error {
+	err := b.object(oid).Delete(context.Background())
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	return nil
+}
+
+func (b *GCSBackend) List(callback func(object *Object) error) error {
+	prefix := b.configuration.keyPrefix()
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "Updated", "StorageClass"}); err != nil {
+		return err
+	}
+	objects := b.bucket.Objects(context.Background(), query)
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %v", err)
+		}
+		oid := strings.TrimPrefix(attrs.Name, prefix)
+		if !oidPattern.MatchString(oid) {
+			continue
+		}
+		err = callback(&Object{
+			Oid:          oid,
+			Size:         attrs.Size,
+			LastModified: attrs.Updated,
+			StorageClass: attrs.StorageClass,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
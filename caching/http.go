@@ -0,0 +1,456 @@
+package caching
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/git-lfs/git-lfs/v3/creds"
+)
+
+var _ Backend = (*HTTPBackend)(nil)
+
+// HTTPBackend stores the cache on a plain HTTP server, such as a WebDAV share.
+// Objects are read and written with GET and PUT requests to the URL of the
+// endpoint, followed by the prefix and the OID. Listing objects requires the
+// server to support PROPFIND. Objects are not streamed into the cache, since
+// the server stores a PUT request once it received the announced number of
+// bytes, before the object could be verified against its OID.
+type HTTPBackend struct {
+	authorization    string
+	authMutex        sync.Mutex
+	baseURL          string
+	client           *http.Client
+	collections      sync.Once
+	configuration    *cachingConfiguration
+	credentials      *creds.CredentialHelperWrapper
+	rangeConcurrency int
+	rangeSize        int64
+}
+
+func NewHTTPBackend(configuration *cachingConfiguration) (*HTTPBackend, error) {
+	if configuration.Endpoint == nil {
+		return nil, errors.New("no endpoint configured for the HTTP cache backend")
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(*configuration.Endpoint, "/"))
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") {
+		return nil, fmt.Errorf("invalid endpoint %q for the HTTP cache backend", *configuration.Endpoint)
+	}
+
+	// Credentials in the URL are used right away, instead of asking the
+	// credential helpers once the server asks for credentials.
+	backend := &HTTPBackend{
+		configuration:    configuration,
+		rangeConcurrency: configuration.DownloadRangeConcurrency(),
+		rangeSize:        configuration.DownloadRangeSize(),
+	}
+	if baseURL.User != nil {
+		password, _ := baseURL.User.Password()
+		request := &http.Request{Header: make(http.Header)}
+		request.SetBasicAuth(baseURL.User.Username(), password)
+		backend.authorization = request.Header.Get("Authorization")
+		baseURL.User = nil
+	}
+	backend.baseURL = baseURL.String()
+
+	backend.client, err = configuration.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Using HTTP cache backend at %s\n", backend.baseURL)
+	return backend, nil
+}
+
+// newHTTPClient creates a client that trusts the certificates in the configured
+// CA bundle, in addition to the certificates of the system.
+func (c *cachingConfiguration) newHTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.CABundle != nil {
+		bundle, err := os.ReadFile(*c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", *c.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func (b *HTTPBackend) url(oid string) string {
+	return fmt.Sprintf("%s/%s%s", b.baseURL, b.configuration.keyPrefix(), oid)
+}
+
+// do sends the request. When the server asks for credentials, they are filled
+// by the Git credential helpers and the request is sent again, if its body can
+// be sent again.
+func (b *HTTPBackend) do(request *http.Request) (*http.Response, error) {
+	authorization := b.authorize(request)
+	response, err := b.client.Do(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized || b.configuration.credentials == nil {
+		return response, err
+	}
+	if request.Body != nil && request.GetBody == nil {
+		return response, nil
+	}
+	response.Body.Close()
+
+	if err := b.fillCredentials(response, authorization); err != nil {
+		return nil, err
+	}
+	retry := request.Clone(request.Context())
+	if request.GetBody != nil {
+		if retry.Body, err = request.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	authorization = b.authorize(retry)
+	response, err = b.client.Do(retry)
+	if err != nil {
+		return nil, err
+	}
+	b.reportCredentials(authorization, response.StatusCode != http.StatusUnauthorized)
+	return response, nil
+}
+
+// authorize adds the current credentials to the request, and returns them.
+func (b *HTTPBackend) authorize(request *http.Request) string {
+	b.authMutex.Lock()
+	defer b.authMutex.Unlock()
+	if b.authorization != "" {
+		request.Header.Set("Authorization", b.authorization)
+	}
+	return b.authorization
+}
+
+// fillCredentials asks the Git credential helpers for credentials for the
+// endpoint, unless another request did so already after the given credentials
+// were rejected.
+func (b *HTTPBackend) fillCredentials(response *http.Response, rejected string) error {
+	b.authMutex.Lock()
+	defer b.authMutex.Unlock()
+	if b.authorization != rejected {
+		return nil
+	}
+
+	baseURL, err := url.Parse(b.baseURL)
+	if err != nil {
+		return err
+	}
+	b.configuration.credentials.SetWWWAuthHeaders(response.Header.Values("Www-Authenticate"))
+	credentials := b.configuration.credentials.GetCredentialHelper(nil, baseURL)
+	if err := credentials.FillCreds(); err != nil {
+		return fmt.Errorf("failed to get credentials for the cache: %v", err)
+	}
+	b.credentials = &credentials
+
+	// Credential helpers return either a username and a password, or a
+	// credential for the given authentication scheme, such as a bearer token.
+	authType := creds.FirstEntryForKey(credentials.Creds, "authtype")
+	credential := creds.FirstEntryForKey(credentials.Creds, "credential")
+	if authType != "" && credential != "" {
+		b.authorization = fmt.Sprintf("%s %s", authType, credential)
+	} else {
+		request := &http.Request{Header: make(http.Header)}
+		request.SetBasicAuth(creds.FirstEntryForKey(credentials.Creds, "username"), creds.FirstEntryForKey(credentials.Creds, "password"))
+		b.authorization = request.Header.Get("Authorization")
+	}
+	return nil
+}
+
+// reportCredentials tells the Git credential helpers whether the credentials
+// they filled were accepted, such that they can store or forget them.
+func (b *HTTPBackend) reportCredentials(authorization string, accepted bool) {
+	b.authMutex.Lock()
+	defer b.authMutex.Unlock()
+	if b.credentials == nil || b.authorization != authorization {
+		return
+	}
+	var err error
+	if accepted {
+		err = b.credentials.CredentialHelper.Approve(b.credentials.Creds)
+	} else {
+		err = b.credentials.CredentialHelper.Reject(b.credentials.Creds)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to report credentials for the cache to the credential helpers: %v\n", err)
+	}
+	b.credentials = nil
+}
+
+func (b *HTTPBackend) Exists(oid string, size int64) (bool, error) {
+	request, err := http.NewRequest(http.MethodHead, b.url(oid), nil)
+	if err != nil {
+		return false, err
+	}
+	response, err := b.do(request)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	if response.ContentLength >= 0 && response.ContentLength != size {
+		return false, fmt.Errorf("object size mismatch: expected %d, got %d", size, response.ContentLength)
+	}
+	return true, nil
+}
+
+func (b *HTTPBackend) Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	if ok, err := b.Exists(oid, size); !ok {
+		return false, err
+	}
+
+	// Create the destination file, with room for the entire object
+	file, err := os.Create(dest)
+	if err != nil {
+		return false, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		os.Remove(dest)
+		return false, fmt.Errorf("failed to allocate file: %v", err)
+	}
+
+	// Download the object in multiple ranges at the same time if it is large
+	// enough
+	progress := &downloadProgress{progressCallback: progressCallback}
+	if err := downloadRanges(file, oid, size, b.rangeConcurrency, b.rangeSize, progress, b.rangeOpener(oid, size)); err != nil {
+		os.Remove(dest)
+		return false, err
+	}
+
+	// Verify that the contents of the file match the OID
+	if err := verifyFile(file, oid, size); err != nil {
+		file.Close()
+		os.Remove(dest)
+		if !errors.Is(err, ErrInvalidObject) {
+			return false, err
+		}
+		return false, removeCorruptObject(b, b.configuration.writable(), oid, size, err, b.verifyStored)
+	}
+
+	return true, nil
+}
+
+// rangeOpener returns a function that opens ranges of the object. Servers that
+// do not support range requests can only serve objects in a single range.
+func (b *HTTPBackend) rangeOpener(oid string, size int64) rangeOpener {
+	return func(offset int64, end int64) (io.ReadCloser, error) {
+		request, err := http.NewRequest(http.MethodGet, b.url(oid), nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+		response, err := b.do(request)
+		if err != nil {
+			return nil, err
+		}
+		switch response.StatusCode {
+		case http.StatusPartialContent:
+			err = checkContentRange(response.Header.Get("Content-Range"), offset, end, size)
+		case http.StatusOK:
+			err = checkContentRange("", offset, end, size)
+		default:
+			err = fmt.Errorf("unexpected status %s", response.Status)
+		}
+		if err != nil {
+			response.Body.Close()
+			return nil, err
+		}
+		return response.Body, nil
+	}
+}
+
+// verifyStored reads the object in full, without ranges, and checks whether it
+// matches its OID.
+func (b *HTTPBackend) verifyStored(oid string, size int64) error {
+	request, err := http.NewRequest(http.MethodGet, b.url(oid), nil)
+	if err != nil {
+		return err
+	}
+	response, err := b.do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return verifyStream(response.Body, oid, size)
+}
+
+func (b *HTTPBackend) Upload(source string, oid string, size int64) (bool, error) {
+	uploaded, err := b.Exists(oid, size)
+	if uploaded && err == nil {
+		return false, nil
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return false, fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer file.Close()
+
+	// Make sure that the cache is never poisoned with objects that do not
+	// match their OID
+	if err := verifyFile(file, oid, size); err != nil {
+		return false, err
+	}
+
+	request, err := http.NewRequest(http.MethodPut, b.url(oid), io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return false, err
+	}
+	request.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(file, 0, size)), nil
+	}
+	return b.put(request, size)
+}
+
+func (b *HTTPBackend) put(request *http.Request, size int64) (bool, error) {
+	b.collections.Do(b.createCollections)
+
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := b.do(request)
+	if err != nil {
+		return false, fmt.Errorf("failed to upload file to the cache: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusNoContent {
+		return false, fmt.Errorf("failed to upload file to the cache: unexpected status %s", response.Status)
+	}
+	return true, nil
+}
+
+// createCollections creates the collections of the prefix on WebDAV servers,
+// which do not create missing collections on PUT. Other servers may not
+// support this, so failures are ignored.
+func (b *HTTPBackend) createCollections() {
+	prefix := strings.TrimSuffix(b.configuration.keyPrefix(), "/")
+	if prefix == "" {
+		return
+	}
+	collection := b.baseURL
+	for _, segment := range strings.Split(prefix, "/") {
+		collection = fmt.Sprintf("%s/%s", collection, segment)
+		request, err := http.NewRequest("MKCOL", collection+"/", nil)
+		if err != nil {
+			return
+		}
+		response, err := b.do(request)
+		if err != nil {
+			return
+		}
+		response.Body.Close()
+	}
+}
+
+func (b *HTTPBackend) Delete(oid string) error {
+	request, err := http.NewRequest(http.MethodDelete, b.url(oid), nil)
+	if err != nil {
+		return err
+	}
+	response, err := b.do(request)
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 && response.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete object: unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// davMultiStatus is the response of a WebDAV server to a PROPFIND request.
+type davMultiStatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		PropStats []struct {
+			Prop struct {
+				ContentLength string    `xml:"DAV: getcontentlength"`
+				LastModified  string    `xml:"DAV: getlastmodified"`
+				Collection    *struct{} `xml:"DAV: resourcetype>collection"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+const davPropFind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><getcontentlength/><getlastmodified/><resourcetype/></prop></propfind>`
+
+func (b *HTTPBackend) List(callback func(object *Object) error) error {
+	request, err := http.NewRequest("PROPFIND", fmt.Sprintf("%s/%s", b.baseURL, b.configuration.keyPrefix()), strings.NewReader(davPropFind))
+	if err != nil {
+		return err
+	}
+	request.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(davPropFind)), nil
+	}
+	request.Header.Set("Content-Type", "application/xml")
+	request.Header.Set("Depth", "1")
+	response, err := b.do(request)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %v", err)
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("failed to list objects: unexpected status %s, the server may not support WebDAV", response.Status)
+	}
+
+	var multiStatus davMultiStatus
+	if err := xml.NewDecoder(response.Body).Decode(&multiStatus); err != nil {
+		return fmt.Errorf("failed to list objects: %v", err)
+	}
+	for _, entry := range multiStatus.Responses {
+		href, err := url.PathUnescape(entry.Href)
+		if err != nil {
+			continue
+		}
+		oid := path.Base(href)
+		if !oidPattern.MatchString(oid) {
+			continue
+		}
+		for _, propStat := range entry.PropStats {
+			if !strings.Contains(propStat.Status, " 200 ") || propStat.Prop.Collection != nil {
+				continue
+			}
+			size, err := strconv.ParseInt(propStat.Prop.ContentLength, 10, 64)
+			if err != nil {
+				continue
+			}
+			lastModified, _ := time.Parse(http.TimeFormat, propStat.Prop.LastModified)
+			if err := callback(&Object{Oid: oid, Size: size, LastModified: lastModified}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,7 +1,12 @@
 package caching
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
+	"os"
 )
 
 type progressReader struct {
@@ -19,3 +24,70 @@ func (r *progressReader) Read(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+// verifyFile checks whether the contents of the file match the given OID and
+// size, and rewinds the file afterwards.
+func verifyFile(file *os.File, oid string, size int64) error {
+	hash := sha256.New()
+	written, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("failed to read source file: %v", err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); written != size || actual != oid {
+		return fmt.Errorf("%w: expected OID %s of %d bytes, got %s of %d bytes", ErrInvalidObject, oid, size, actual, written)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind source file: %v", err)
+	}
+	return nil
+}
+
+// verifyStream reads the object from the reader, and checks whether its contents
+// match the given OID and size.
+func verifyStream(reader io.Reader, oid string, size int64) error {
+	_, err := io.Copy(io.Discard, newVerifyingReader(reader, oid, size))
+	return err
+}
+
+// verifyingReader verifies the object that is read from the reader against its
+// OID and size. Instead of the end of the stream, it returns an error wrapping
+// ErrInvalidObject if the object does not match, such that uploads of the stream
+// fail before the object is stored. The error is kept in err as well, for
+// clients that do not pass on errors of the reader.
+type verifyingReader struct {
+	err    error
+	hash   hash.Hash
+	oid    string
+	reader io.Reader
+	size   int64
+	read   int64
+}
+
+func newVerifyingReader(reader io.Reader, oid string, size int64) *verifyingReader {
+	return &verifyingReader{
+		hash:   sha256.New(),
+		oid:    oid,
+		reader: reader,
+		size:   size,
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+	if r.read > r.size {
+		r.err = fmt.Errorf("%w: expected OID %s of %d bytes, got more bytes", ErrInvalidObject, r.oid, r.size)
+		return n, r.err
+	}
+	if err == io.EOF {
+		if actual := hex.EncodeToString(r.hash.Sum(nil)); r.read != r.size || actual != r.oid {
+			r.err = fmt.Errorf("%w: expected OID %s of %d bytes, got %s of %d bytes", ErrInvalidObject, r.oid, r.size, actual, r.read)
+			return n, r.err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+package caching
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LocalCache is a cache on the local disk, which is shared by all repositories
+// of the user. It is checked before the cache backend, and keeps its size within
+// a budget by evicting the least recently used objects.
+type LocalCache struct {
+	backend            *FilesystemBackend
+	budget             int64
+	bytesSinceEviction int64
+	mutex              sync.Mutex
+}
+
+// NewLocalCache creates the local cache, if it is configured.
+func NewLocalCache(configuration *cachingConfiguration) (*LocalCache, error) {
+	directory, err := configuration.LocalCacheDirectory()
+	if err != nil || directory == "" {
+		return nil, err
+	}
+	budget := configuration.LocalCacheBudget()
+	fmt.Fprintf(os.Stderr, "Using local cache in %s, with a budget of %d bytes\n", directory, budget)
+
+	backend, err := newFilesystemBackend(directory, false)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalCache{
+		backend: backend,
+		budget:  budget,
+	}, nil
+}
+
+// Download copies the object from the local cache to dest. It returns false
+// without an error if the object is not in the local cache.
+func (c *LocalCache) Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	ok, err := c.backend.Download(dest, oid, size, progressCallback)
+	if ok {
+		// Marks the object as recently used
+		now := time.Now()
+		os.Chtimes(c.backend.path(oid), now, now)
+	}
+	return ok, err
+}
+
+// Add copies the object at source into the local cache, evicting objects when
+// the cache grew too large.
+func (c *LocalCache) Add(source string, oid string, size int64) error {
+	added, err := c.backend.Upload(source, oid, size)
+	if !added {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.bytesSinceEviction += size
+	evict := c.bytesSinceEviction > c.budget/10
+	c.mutex.Unlock()
+	if evict {
+		return c.Evict()
+	}
+	return nil
+}
+
+// Evict removes the least recently used objects from the local cache, until it
+// fits within its budget again.
+func (c *LocalCache) Evict() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.bytesSinceEviction = 0
+
+	var objects []*Object
+	total := int64(0)
+	err := c.backend.List(func(object *Object) error {
+		objects = append(objects, object)
+		total += object.Size
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list local cache: %v", err)
+	}
+	if total <= c.budget {
+		return nil
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].LastModified.Before(objects[j].LastModified)
+	})
+	for _, object := range objects {
+		if total <= c.budget {
+			break
+		}
+		if err := c.backend.Delete(object.Oid); err != nil {
+			return err
+		}
+		total -= object.Size
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package caching
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
+)
+
+var _ StreamingBackend = (*MultiBackend)(nil)
+
+type cacheTarget struct {
+	backend  Backend
+	name     string
+	writable bool
+}
+
+// MultiBackend combines an ordered list of cache targets. Objects are read from
+// the first target that has them, and added to all writable targets. The
+// results of every target are reported to UpdateStats, if set.
+type MultiBackend struct {
+	// readTargets are the targets objects are read from, in order. Unless
+	// probing is disabled, these are the healthy targets, fastest first.
+	readTargets []*cacheTarget
+	targets     []*cacheTarget
+	UpdateStats func(update func(s *stats.Stats))
+}
+
+func NewMultiBackend(configuration *cachingConfiguration) (*MultiBackend, error) {
+	backend := &MultiBackend{
+		UpdateStats: nil,
+	}
+	for _, targetConfiguration := range configuration.Targets {
+		name := targetConfiguration.name()
+		fmt.Fprintf(os.Stderr, "Setting up cache target '%s'\n", name)
+		targetBackend, err := NewBackend(targetConfiguration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up cache target %s: %v", name, err)
+		}
+		if targetBackend == nil {
+			return nil, fmt.Errorf("cache target %s is not configured", name)
+		}
+		backend.targets = append(backend.targets, &cacheTarget{
+			backend:  targetBackend,
+			name:     name,
+			writable: targetConfiguration.writable(),
+		})
+	}
+
+	backend.readTargets = backend.targets
+	if ttl := configuration.TargetProbeTTL(); ttl > 0 && len(backend.targets) > 1 {
+		backend.readTargets = orderByLatency(backend.targets, configuration.storageDir, ttl)
+	}
+	return backend, nil
+}
+
+// WithUpdateStats returns a copy of the backend, which shares the targets of
+// the backend but reports their results to the given function instead. This
+// allows attributing the results to the session that caused them, when a
+// single backend serves multiple sessions.
+func (b *MultiBackend) WithUpdateStats(updateStats func(update func(s *stats.Stats))) *MultiBackend {
+	backend := *b
+	backend.UpdateStats = updateStats
+	return &backend
+}
+
+func (b *MultiBackend) updateTarget(target *cacheTarget, update func(s *stats.TargetStats)) {
+	if b.UpdateStats != nil {
+		b.UpdateStats(func(s *stats.Stats) {
+			update(s.Target(target.name))
+		})
+	}
+}
+
+func (b *MultiBackend) Exists(oid string, size int64) (bool, error) {
+	var firstErr error
+	for _, target := range b.readTargets {
+		exists, err := target.backend.Exists(oid, size)
+		if exists {
+			return true, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return false, firstErr
+}
+
+func (b *MultiBackend) Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	var firstErr error
+	for _, target := range b.readTargets {
+		ok, err := target.backend.Download(dest, oid, size, progressCallback)
+		if ok {
+			b.updateTarget(target, func(s *stats.TargetStats) {
+				s.CacheHits++
+				s.BytesTransferredFromCache += uint64(size)
+			})
+			fmt.Fprintf(os.Stderr, "Found object %s in cache target %s\n", oid, target.name)
+			return true, nil
+		}
+		if err == nil {
+			b.updateTarget(target, func(s *stats.TargetStats) { s.CacheMisses++ })
+			continue
+		}
+
+		b.updateTarget(target, func(s *stats.TargetStats) { s.CacheErrors++ })
+		fmt.Fprintf(os.Stderr, "Cache target %s failed to provide object %s. %s\n", target.name, oid, err.Error())
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return false, firstErr
+}
+
+func (b *MultiBackend) Upload(source string, oid string, size int64) (bool, error) {
+	uploaded := false
+	var errs []error
+	for _, target := range b.targets {
+		if !target.writable {
+			continue
+		}
+		targetUploaded, err := target.backend.Upload(source, oid, size)
+		if targetUploaded {
+			b.updateTarget(target, func(s *stats.TargetStats) {
+				s.CacheAdded++
+				s.BytesTransferredToCache += uint64(size)
+			})
+			uploaded = true
+		} else if err != nil {
+			b.updateTarget(target, func(s *stats.TargetStats) { s.CacheErrors++ })
+			fmt.Fprintf(os.Stderr, "Cache target %s failed to add object %s. %s\n", target.name, oid, err.Error())
+			errs = append(errs, err)
+		}
+	}
+	return uploaded, errors.Join(errs...)
+}
+
+// streamingTarget returns the cache target objects can be streamed into. This
+// is only possible if there is a single writable cache target, which supports
+// streaming.
+func (b *MultiBackend) streamingTarget() *cacheTarget {
+	var writable *cacheTarget
+	for _, target := range b.targets {
+		if !target.writable {
+			continue
+		}
+		if writable != nil {
+			return nil
+		}
+		writable = target
+	}
+	if writable == nil {
+		return nil
+	}
+	if _, ok := writable.backend.(StreamingBackend); !ok {
+		return nil
+	}
+	return writable
+}
+
+// UploadStream adds the object that is read from reader to the only writable
+// cache target. AsStreamingBackend tells whether this is possible.
+func (b *MultiBackend) UploadStream(reader io.Reader, oid string, size int64) (bool, error) {
+	target := b.streamingTarget()
+	if target == nil {
+		return false, errors.New("streaming is only supported with a single writable cache target")
+	}
+	uploaded, err := target.backend.(StreamingBackend).UploadStream(reader, oid, size)
+	if uploaded {
+		b.updateTarget(target, func(s *stats.TargetStats) {
+			s.CacheAdded++
+			s.BytesTransferredToCache += uint64(size)
+		})
+	} else if err != nil {
+		b.updateTarget(target, func(s *stats.TargetStats) { s.CacheErrors++ })
+		fmt.Fprintf(os.Stderr, "Cache target %s failed to add object %s. %s\n", target.name, oid, err.Error())
+	}
+	return uploaded, err
+}
+
+// Delete removes the object from all writable cache targets. Read-only cache
+// targets are never changed.
+func (b *MultiBackend) Delete(oid string) error {
+	var errs []error
+	for _, target := range b.targets {
+		if !target.writable {
+			continue
+		}
+		if err := target.backend.Delete(oid); err != nil {
+			errs = append(errs, fmt.Errorf("cache target %s: %w", target.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List lists the objects of all cache targets. Objects that are in multiple
+// targets are only listed for the first target that has them.
+func (b *MultiBackend) List(callback func(object *Object) error) error {
+	listed := make(map[string]bool)
+	for _, target := range b.targets {
+		err := target.backend.List(func(object *Object) error {
+			if listed[object.Oid] {
+				return nil
+			}
+			listed[object.Oid] = true
+			return callback(object)
+		})
+		if err != nil {
+			return fmt.Errorf("cache target %s: %w", target.name, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the cache targets that need to be closed.
+func (b *MultiBackend) Close() error {
+	var errs []error
+	for _, target := range b.targets {
+		if closer, ok := target.backend.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("cache target %s: %w", target.name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
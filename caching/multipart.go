@@ -0,0 +1,174 @@
+package caching
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	maximumParts = 10000
+	partAttempts = 3
+)
+
+// multipartUpload uploads a single object to the bucket in multiple parts. Parts
+// are uploaded in the background, with a limited number of parts in flight.
+type multipartUpload struct {
+	adapter  *S3CachingAdapter
+	ctx      context.Context
+	err      error
+	inFlight chan struct{}
+	key      *string
+	mutex    sync.Mutex
+	parts    []types.CompletedPart
+	uploadId *string
+	uploads  sync.WaitGroup
+}
+
+// partSizeFor returns the size of the parts to split an object of the given size
+// into, such that the number of parts stays within the limits of S3.
+func (a *S3CachingAdapter) partSizeFor(size int64) int64 {
+	partSize := a.partSize
+	if size/partSize >= maximumParts {
+		partSize = size/(maximumParts-1) + 1
+	}
+	return partSize
+}
+
+func (a *S3CachingAdapter) newMultipartUpload(ctx context.Context, oid string) (*multipartUpload, error) {
+	key := a.key(oid)
+	output, err := a.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            a.configuration.Bucket,
+		Key:               key,
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %v", err)
+	}
+	return &multipartUpload{
+		adapter:  a,
+		ctx:      ctx,
+		inFlight: make(chan struct{}, a.partConcurrency),
+		key:      key,
+		uploadId: output.UploadId,
+	}, nil
+}
+
+// uploadMultipart uploads the file to the bucket in parts of the configured
+// size, which are read from the file independently.
+func (a *S3CachingAdapter) uploadMultipart(file *os.File, oid string, size int64) error {
+	upload, err := a.newMultipartUpload(context.Background(), oid)
+	if err != nil {
+		return err
+	}
+	partSize := a.partSizeFor(size)
+	for number, offset := int32(1), int64(0); offset < size; number, offset = number+1, offset+partSize {
+		upload.uploadPart(number, io.NewSectionReader(file, offset, min(partSize, size-offset)))
+	}
+	return upload.complete()
+}
+
+// uploadPart uploads the given part in the background. It blocks while the
+// maximum number of parts is in flight. A failed part is retried a few times,
+// before the upload as a whole is considered failed.
+func (u *multipartUpload) uploadPart(number int32, body io.ReadSeeker) {
+	u.inFlight <- struct{}{}
+	u.uploads.Add(1)
+	go func() {
+		defer func() {
+			<-u.inFlight
+			u.uploads.Done()
+		}()
+
+		var output *s3.UploadPartOutput
+		var err error
+		for attempt := 1; attempt <= partAttempts && !u.failed(); attempt++ {
+			if attempt > 1 {
+				fmt.Fprintf(os.Stderr, "Retrying upload of part %d of multipart upload %s: %s\n", number, *u.uploadId, err.Error())
+				time.Sleep(time.Duration(attempt-1) * time.Second)
+			}
+			if _, err = body.Seek(0, io.SeekStart); err != nil {
+				break
+			}
+			output, err = u.adapter.client.UploadPart(u.ctx, &s3.UploadPartInput{
+				Bucket:            u.adapter.configuration.Bucket,
+				Key:               u.key,
+				UploadId:          u.uploadId,
+				PartNumber:        aws.Int32(number),
+				Body:              body,
+				ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+			})
+			if err == nil {
+				break
+			}
+		}
+
+		u.mutex.Lock()
+		defer u.mutex.Unlock()
+		if u.err != nil {
+			return
+		}
+		if err != nil {
+			u.err = fmt.Errorf("failed to upload part %d: %v", number, err)
+			return
+		}
+		u.parts = append(u.parts, types.CompletedPart{
+			ETag:          output.ETag,
+			PartNumber:    aws.Int32(number),
+			ChecksumCRC32: output.ChecksumCRC32,
+		})
+	}()
+}
+
+func (u *multipartUpload) failed() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.err != nil
+}
+
+// complete waits for all parts to be uploaded and completes the upload. The
+// upload is aborted if any of the parts failed.
+func (u *multipartUpload) complete() error {
+	u.uploads.Wait()
+	if u.err != nil {
+		u.abort()
+		return u.err
+	}
+
+	sort.Slice(u.parts, func(i, j int) bool {
+		return *u.parts[i].PartNumber < *u.parts[j].PartNumber
+	})
+	_, err := u.adapter.client.CompleteMultipartUpload(u.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          u.adapter.configuration.Bucket,
+		Key:             u.key,
+		UploadId:        u.uploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: u.parts},
+	})
+	if err != nil {
+		u.abort()
+		return fmt.Errorf("failed to complete multipart upload: %v", err)
+	}
+	return nil
+}
+
+// abort waits for all parts in flight and aborts the upload, such that the
+// uploaded parts do not linger in the bucket.
+func (u *multipartUpload) abort() {
+	u.uploads.Wait()
+	_, err := u.adapter.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   u.adapter.configuration.Bucket,
+		Key:      u.key,
+		UploadId: u.uploadId,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to abort multipart upload %s: %v\n", *u.uploadId, err)
+	}
+}
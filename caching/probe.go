@@ -0,0 +1,165 @@
+package caching
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// probeOid is the OID of the empty object. Checking whether it exists is
+	// a cheap request to any backend. Empty objects are valid LFS objects, so
+	// it may be in the cache. Either way, the target counts as healthy if the
+	// request succeeds.
+	probeOid     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	probeFile    = "cache_probes.json"
+	probeTimeout = 5 * time.Second
+
+	// unhealthyProbeTTL is how long unhealthy results are reused at most, such
+	// that targets recover soon after an outage.
+	unhealthyProbeTTL = time.Minute
+)
+
+// probeResult is the outcome of probing a single cache target. The results are
+// stored in the LFS storage directory, such that they are shared by sessions.
+type probeResult struct {
+	Healthy  bool          `json:"healthy"`
+	Latency  time.Duration `json:"latency"`
+	ProbedAt time.Time     `json:"probed_at"`
+}
+
+// orderByLatency returns the healthy targets, fastest first. Targets are only
+// probed if no result of them is known that is younger than the TTL, or than
+// unhealthyProbeTTL for unhealthy targets.
+func orderByLatency(targets []*cacheTarget, storageDir string, ttl time.Duration) []*cacheTarget {
+	results := readProbeResults(storageDir)
+
+	var unprobed []*cacheTarget
+	for _, target := range targets {
+		result, ok := results[target.name]
+		if !ok || time.Since(result.ProbedAt) > ttl || !result.Healthy && time.Since(result.ProbedAt) > unhealthyProbeTTL {
+			unprobed = append(unprobed, target)
+		}
+	}
+	if len(unprobed) > 0 {
+		for name, result := range probeTargets(unprobed) {
+			results[name] = result
+		}
+		if err := writeProbeResults(storageDir, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to store the probe results of the cache targets: %v\n", err)
+		}
+	}
+
+	var healthy []*cacheTarget
+	for _, target := range targets {
+		if results[target.name].Healthy {
+			healthy = append(healthy, target)
+		} else {
+			fmt.Fprintf(os.Stderr, "Cache target %s is unhealthy. Not reading from it until it is probed again\n", target.name)
+		}
+	}
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return results[healthy[i].name].Latency < results[healthy[j].name].Latency
+	})
+	for _, target := range healthy {
+		fmt.Fprintf(os.Stderr, "Reading from cache target %s, which responded in %s\n", target.name, results[target.name].Latency)
+	}
+	if len(healthy) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: no cache target is healthy, so no objects are read from the cache. The cache targets are probed again in %s at most\n", min(ttl, unhealthyProbeTTL))
+	}
+	return healthy
+}
+
+// probeTargets probes the targets in parallel. Targets that do not respond in
+// time are considered unhealthy.
+func probeTargets(targets []*cacheTarget) map[string]*probeResult {
+	type probe struct {
+		name   string
+		result *probeResult
+	}
+	probes := make(chan probe, len(targets))
+	for _, target := range targets {
+		go func(target *cacheTarget) {
+			start := time.Now()
+			_, err := target.backend.Exists(probeOid, 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to probe cache target %s: %v\n", target.name, err)
+			}
+			probes <- probe{
+				name: target.name,
+				result: &probeResult{
+					Healthy:  err == nil,
+					Latency:  time.Since(start),
+					ProbedAt: start,
+				},
+			}
+		}(target)
+	}
+
+	results := make(map[string]*probeResult)
+	timeout := time.After(probeTimeout)
+	for len(results) < len(targets) {
+		select {
+		case probe := <-probes:
+			results[probe.name] = probe.result
+		case <-timeout:
+			for _, target := range targets {
+				if _, ok := results[target.name]; !ok {
+					fmt.Fprintf(os.Stderr, "Cache target %s did not respond within %s\n", target.name, probeTimeout)
+					results[target.name] = &probeResult{
+						Healthy:  false,
+						Latency:  probeTimeout,
+						ProbedAt: time.Now(),
+					}
+				}
+			}
+		}
+	}
+	return results
+}
+
+func readProbeResults(storageDir string) map[string]*probeResult {
+	results := make(map[string]*probeResult)
+	if storageDir == "" {
+		return results
+	}
+	file, err := os.Open(filepath.Join(storageDir, probeFile))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Failed to read the probe results of the cache targets: %v\n", err)
+		}
+		return results
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&results); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to decode the probe results of the cache targets. Will probe again\n")
+		return make(map[string]*probeResult)
+	}
+	return results
+}
+
+// writeProbeResults replaces the stored probe results at once, as other
+// sessions may be reading them at the same time.
+func writeProbeResults(storageDir string, results map[string]*probeResult) error {
+	if storageDir == "" {
+		return nil
+	}
+	file, err := os.CreateTemp(storageDir, ".cache_probes-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(results); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(storageDir, probeFile))
+}
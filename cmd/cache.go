@@ -0,0 +1,60 @@
+/*
+Copyright © 2024 Remco de Man <remco@heliumnet.nl>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/lfs"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the objects in the cache of the current repository",
+	Long: `Manage the objects in the cache that is configured for the current repository.
+
+The cache is configured exactly like it is for the adapter, so these commands
+operate on the same objects the adapter reads and adds.`,
+}
+
+// openCache creates the cache backend the adapter uses in the current
+// repository.
+func openCache() (caching.Backend, error) {
+	config := lfs.GetPassthroughConfiguration()
+	if !config.InRepo() {
+		return nil, errors.New("not in a git repository")
+	}
+	backend, err := caching.NewBackend(caching.GetCachingConfiguration(config))
+	if err != nil {
+		return nil, err
+	}
+	if backend == nil {
+		return nil, errors.New("no cache is configured for this repository")
+	}
+	return backend, nil
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+}
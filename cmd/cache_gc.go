@@ -0,0 +1,131 @@
+/*
+Copyright © 2024 Remco de Man <remco@heliumnet.nl>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
+)
+
+var (
+	gcDryRun  = false
+	gcMaxAge  time.Duration
+	gcMaxSize int64
+	gcPolicy  = caching.GCPolicyModified
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove objects from the cache by age and total size",
+	Long: `Remove objects from the cache of the current repository, i.e. the objects below
+the configured prefix.
+
+Objects that were not used for longer than --max-age are removed. Then, as long
+as the remaining objects take up more than --max-size bytes, the least recently
+used objects are removed.
+
+By default, the time an object was added to the cache is used as the time it
+was last used. With --policy lru, the last time an object was read from the
+cache is used instead, as recorded by the adapters in the access logs of the
+cache. This requires an S3 cache, and adapters that record reads, which they do
+by default. The access logs are compacted afterwards.
+
+With multiple cache targets, garbage is collected in every writable target by
+itself, and the limits apply to each of them. Read-only targets are left alone.
+
+All objects are listed before any object is removed. Use --dry-run to see what
+would be removed first.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if gcMaxAge <= 0 && gcMaxSize <= 0 {
+			cmd.PrintErrln("error: no --max-age or --max-size given, refusing to remove anything")
+			os.Exit(1)
+		}
+		backend, err := openCache()
+		if err != nil {
+			cmd.PrintErrln(err.Error())
+			os.Exit(1)
+		}
+
+		targets := caching.GCTargets(backend)
+		if len(targets) == 0 {
+			caching.CloseBackend(backend)
+			cmd.PrintErrln("error: all cache targets are read-only, refusing to remove anything")
+			os.Exit(1)
+		}
+
+		removedVerb := "Removed"
+		if gcDryRun {
+			removedVerb = "Would remove"
+		}
+		failed := false
+		for _, target := range targets {
+			if target.Name != "" {
+				cmd.Printf("Cache target %s:\n", target.Name)
+			}
+			report, err := caching.CollectGarbage(target.Backend, &caching.GCOptions{
+				DryRun:  gcDryRun,
+				MaxAge:  gcMaxAge,
+				MaxSize: gcMaxSize,
+				Policy:  gcPolicy,
+			}, func(object *caching.Object, lastUsed time.Time) {
+				if verbose || gcDryRun {
+					cmd.Printf("%s %s (%s, last used %s)\n", removedVerb, object.Oid, stats.ByteCountIEC(uint64(object.Size)), lastUsed.Local().Format(time.RFC3339))
+				}
+			})
+			if err != nil {
+				cmd.PrintErrln(err.Error())
+				failed = true
+				continue
+			}
+
+			cmd.Printf("Found %d objects, taking up %s\n", report.Objects, stats.ByteCountIEC(uint64(report.Bytes)))
+			cmd.Printf("%s %d objects, freeing %s (%d bytes)\n", removedVerb, len(report.Removed), stats.ByteCountIEC(uint64(report.BytesFreed)), report.BytesFreed)
+			if len(report.Errors) > 0 {
+				for _, err := range report.Errors {
+					cmd.PrintErrln(err.Error())
+				}
+				cmd.PrintErrf("warning: %d objects could not be removed\n", len(report.Errors))
+				failed = true
+			}
+		}
+		if err := caching.CloseBackend(backend); err != nil {
+			cmd.PrintErrln(err.Error())
+			failed = true
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	cacheCmd.AddCommand(gcCmd)
+
+	gcCmd.Flags().BoolVarP(&gcDryRun, "dry-run", "n", false, "Only show which objects would be removed")
+	gcCmd.Flags().DurationVar(&gcMaxAge, "max-age", 0, "Remove objects that were not used for longer than this, e.g. 720h")
+	gcCmd.Flags().Int64Var(&gcMaxSize, "max-size", 0, "Remove the least recently used objects until the cache takes up at most this many bytes")
+	gcCmd.Flags().StringVar(&gcPolicy, "policy", gcPolicy, "How the time an object was last used is determined: modified or lru")
+}
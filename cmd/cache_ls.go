@@ -0,0 +1,130 @@
+/*
+Copyright © 2024 Remco de Man <remco@heliumnet.nl>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
+)
+
+var (
+	jsonList       = false
+	listLargerThan int64
+	listOlderThan  time.Duration
+	siList         = false
+)
+
+// listedObject is an object in the JSON output of cache ls.
+type listedObject struct {
+	Oid          string    `json:"oid"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	StorageClass string    `json:"storageClass,omitempty"`
+}
+
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the objects in the cache",
+	Long: `List the objects in the cache of the current repository, i.e. the objects below
+the configured prefix, with their size, the time they were last modified and
+their storage class, if the cache backend has storage classes.
+
+The cache is configured exactly like it is for the adapter, including the
+.lfscaching.json file, the scope and the cache targets, so the listed objects are
+the objects the adapter sees. With multiple cache targets, objects that are in
+multiple targets are listed once.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		backend, err := openCache()
+		if err != nil {
+			cmd.PrintErrln(err.Error())
+			os.Exit(1)
+		}
+
+		now := time.Now()
+		objects := []*listedObject{}
+		err = backend.List(func(object *caching.Object) error {
+			if listLargerThan > 0 && object.Size <= listLargerThan {
+				return nil
+			}
+			if listOlderThan > 0 && now.Sub(object.LastModified) <= listOlderThan {
+				return nil
+			}
+			objects = append(objects, &listedObject{
+				Oid:          object.Oid,
+				Size:         object.Size,
+				LastModified: object.LastModified,
+				StorageClass: object.StorageClass,
+			})
+			return nil
+		})
+		caching.CloseBackend(backend)
+		if err != nil {
+			cmd.PrintErrln(err.Error())
+			os.Exit(1)
+		}
+
+		if jsonList {
+			json, err := json.Marshal(objects)
+			if err != nil {
+				cmd.PrintErrln(err.Error())
+				cmd.PrintErrf("warning: could not encode objects as JSON\n")
+				os.Exit(1)
+			}
+			cmd.Println(string(json))
+			return
+		}
+
+		byteFormatFunc := stats.ByteCountIEC
+		if siList {
+			byteFormatFunc = stats.ByteCountSI
+		}
+		total := int64(0)
+		writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintf(writer, "OID\tSIZE\tLAST MODIFIED\tSTORAGE CLASS\n")
+		for _, object := range objects {
+			storageClass := object.StorageClass
+			if storageClass == "" {
+				storageClass = "-"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", object.Oid, byteFormatFunc(uint64(object.Size)), object.LastModified.Local().Format(time.RFC3339), storageClass)
+			total += object.Size
+		}
+		writer.Flush()
+		cmd.Printf("\nListed %d objects, taking up %s\n", len(objects), byteFormatFunc(uint64(total)))
+	},
+}
+
+func init() {
+	cacheCmd.AddCommand(lsCmd)
+
+	lsCmd.Flags().BoolVarP(&jsonList, "json", "j", false, "Use machine readable JSON output format for the objects")
+	lsCmd.Flags().Int64Var(&listLargerThan, "larger-than", 0, "Only list objects larger than this many bytes")
+	lsCmd.Flags().DurationVar(&listOlderThan, "older-than", 0, "Only list objects that were last modified longer ago than this, e.g. 720h")
+	lsCmd.Flags().BoolVarP(&siList, "si", "s", false, "Use SI units when printing sizes (e.g. 1000 bytes = 1kb), instead of IEC units. This only affects the human readable output format")
+}
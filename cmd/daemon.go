@@ -0,0 +1,90 @@
+/*
+Copyright © 2024 Remco de Man <remco@heliumnet.nl>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/daemon"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/lfs"
+)
+
+var daemonSocket = ""
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run a daemon which performs the cache operations of all adapters of the user.",
+	Long: `Runs a daemon listening on a unix socket, which performs the cache operations of
+all adapter processes of the user on this machine.
+
+Git LFS starts a new adapter process for every command, and every process
+otherwise sets up its own cache backend. Adapters that find the daemon running
+forward their cache operations to it instead, such that all of them share the
+connections of a single cache backend per configuration. Objects that multiple
+adapters request at the same time are only downloaded from the cache once, and
+the statistics of all sessions are written by the daemon. Adapters fall back to
+performing the cache operations themselves if the daemon is not running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if daemonSocket == "" {
+			daemonSocket = caching.GetCachingConfiguration(lfs.GetPassthroughConfiguration()).DaemonSocketPath()
+		}
+		listener, err := daemon.Listen(daemonSocket)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		cacheDaemon := daemon.NewDaemon()
+		httpServer := &http.Server{
+			Handler: cacheDaemon.Handler(),
+		}
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			fmt.Fprintf(os.Stderr, "Shutting down, waiting for running requests\n")
+			httpServer.Shutdown(context.Background())
+		}()
+
+		fmt.Fprintf(os.Stderr, "Listening for adapters on %s\n", daemonSocket)
+		code := 0
+		if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+			fmt.Fprintln(os.Stderr, err.Error())
+			code = 1
+		}
+		cacheDaemon.Close()
+		os.Exit(code)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+
+	daemonCmd.Flags().StringVarP(&daemonSocket, "socket", "s", daemonSocket, "Path of the unix socket to listen on, instead of the configured socket")
+}
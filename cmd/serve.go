@@ -0,0 +1,115 @@
+/*
+Copyright © 2024 Remco de Man <remco@heliumnet.nl>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/server"
+)
+
+var (
+	serveAddress         = "127.0.0.1:8080"
+	serveAuthFile        = ""
+	serveRemote          = "origin"
+	serveUnauthenticated = false
+	serveURL             = ""
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run a Git LFS server which serves downloads from the cache.",
+	Long: `Runs a HTTP server implementing the Git LFS batch API for downloads, in front of
+the upstream LFS server of the repository it is started in.
+
+Objects are served from the cache if possible. Objects missing from the cache
+are downloaded from the upstream LFS server, and added to the cache for the
+next request. Clients only need to point lfs.url at the server, so this also
+works for clients that cannot use the caching adapter. Uploads are not
+supported, push to the upstream LFS server instead.
+
+The server downloads objects using the credentials of the repository it runs
+in, so anyone who can reach it can read every object of the repository. Use
+--auth-file to require clients to authenticate. Listening on other addresses
+than the loopback interface without it is refused, unless
+--allow-unauthenticated is given, e.g. behind a reverse proxy that
+authenticates clients.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var credentials map[string]string
+		if serveAuthFile != "" {
+			var err error
+			credentials, err = server.ReadCredentials(serveAuthFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		} else if !server.IsLoopback(serveAddress) && !serveUnauthenticated {
+			fmt.Fprintf(os.Stderr, "Refusing to serve objects without authentication on %s. Use --auth-file, or --allow-unauthenticated if clients are authenticated otherwise\n", serveAddress)
+			os.Exit(1)
+		}
+
+		lfsServer, err := server.NewServer(serveRemote, serveURL, credentials)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		httpServer := &http.Server{
+			Addr:    serveAddress,
+			Handler: lfsServer.Handler(),
+		}
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			fmt.Fprintf(os.Stderr, "Shutting down, waiting for running requests\n")
+			httpServer.Shutdown(context.Background())
+		}()
+
+		fmt.Fprintf(os.Stderr, "Serving Git LFS batch API on http://%s/\n", serveAddress)
+		code := 0
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Fprintln(os.Stderr, err.Error())
+			code = 1
+		}
+		if err := lfsServer.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+		os.Exit(code)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVarP(&serveAddress, "listen", "l", serveAddress, "Address to listen on")
+	serveCmd.Flags().StringVar(&serveAuthFile, "auth-file", serveAuthFile, "File with a username:password per line, one of which clients must authenticate with")
+	serveCmd.Flags().BoolVar(&serveUnauthenticated, "allow-unauthenticated", serveUnauthenticated, "Allow listening on other addresses than the loopback interface without --auth-file")
+	serveCmd.Flags().StringVarP(&serveRemote, "remote", "r", serveRemote, "Git remote of the upstream LFS server")
+	serveCmd.Flags().StringVar(&serveURL, "url", serveURL, "URL under which clients reach the server, if it differs from the address they send requests to, e.g. behind a reverse proxy")
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 Remco de Man <remco@heliumnet.nl>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/s3server"
+)
+
+var (
+	s3Address   = "127.0.0.1:9000"
+	s3AccessKey = ""
+	s3Buckets   = []string{}
+	s3SecretKey = ""
+)
+
+var serveS3Cmd = &cobra.Command{
+	Use:   "serve-s3 <directory>",
+	Short: "Run a minimal S3 compatible server which stores objects in a directory.",
+	Long: `Runs a HTTP server implementing the subset of the S3 API the caching adapter
+uses, which stores objects in the given directory.
+
+Every directory in it is a bucket. Clients must use path style addressing, and
+sign their requests with the static credentials of the server. These are read
+from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables,
+unless they are given using flags.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if s3AccessKey == "" {
+			s3AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		if s3SecretKey == "" {
+			s3SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		s3Server, err := s3server.NewServer(args[0], s3AccessKey, s3SecretKey, s3Buckets)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		httpServer := &http.Server{
+			Addr:    s3Address,
+			Handler: s3Server,
+		}
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			fmt.Fprintf(os.Stderr, "Shutting down, waiting for running requests\n")
+			httpServer.Shutdown(context.Background())
+		}()
+
+		fmt.Fprintf(os.Stderr, "Serving S3 API for %s on http://%s/\n", args[0], s3Address)
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveS3Cmd)
+
+	serveS3Cmd.Flags().StringVarP(&s3Address, "listen", "l", s3Address, "Address to listen on")
+	serveS3Cmd.Flags().StringVar(&s3AccessKey, "access-key", s3AccessKey, "Access key ID clients must sign their requests with")
+	serveS3Cmd.Flags().StringArrayVarP(&s3Buckets, "bucket", "b", s3Buckets, "Bucket to create if it does not exist yet, may be given multiple times")
+	serveS3Cmd.Flags().StringVar(&s3SecretKey, "secret-key", s3SecretKey, "Secret access key clients must sign their requests with")
+}
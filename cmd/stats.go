@@ -24,6 +24,7 @@ package cmd
 import (
 	"encoding/json"
 	"os"
+	"sort"
 
 	"github.com/spf13/cobra"
 	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
@@ -89,14 +90,36 @@ in multiple statistics entries.`,
 				cmd.Printf("Collected statistics for %d sessions:\n\n", outputStats.Sessions)
 			}
 			cmd.Printf("Objects pulled:                %d\n", outputStats.ObjectsPulled)
+			cmd.Printf("  Local cache hits:            %d (%s)\n", outputStats.LocalCacheHits, stats.Percentage(outputStats.LocalCacheHits, outputStats.ObjectsPulled))
+			cmd.Printf("  Local cache misses:          %d (%s)\n", outputStats.LocalCacheMisses, stats.Percentage(outputStats.LocalCacheMisses, outputStats.ObjectsPulled))
 			cmd.Printf("  Cache hits:                  %d (%s)\n", outputStats.CacheHits, stats.Percentage(outputStats.CacheHits, outputStats.ObjectsPulled))
 			cmd.Printf("  Cache misses:                %d (%s)\n", outputStats.CacheMisses, stats.Percentage(outputStats.CacheMisses, outputStats.ObjectsPulled))
 			cmd.Printf("  Cache errors:                %d (%s)\n", outputStats.CacheErrors, stats.Percentage(outputStats.CacheErrors, outputStats.ObjectsPulled))
+			cmd.Printf("  Cache corrupted:             %d (%s)\n", outputStats.CacheCorrupted, stats.Percentage(outputStats.CacheCorrupted, outputStats.ObjectsPulled))
+			cmd.Printf("  Cache-only refusals:         %d\n", outputStats.CacheOnlyRefusals)
 			cmd.Printf("  Cache additions during pull: %d (%s)\n\n", outputStats.CacheAddedDuringPull, stats.Percentage(outputStats.CacheAddedDuringPull, outputStats.ObjectsPulled))
 
 			cmd.Printf("Objects pushed:                %d\n", outputStats.ObjectsPushed)
 			cmd.Printf("  Cache additions during push: %d (%s)\n\n", outputStats.CacheAddedDuringPush, stats.Percentage(outputStats.CacheAddedDuringPush, outputStats.ObjectsPushed))
 
+			cmd.Printf("Objects rejected by cache:     %d\n\n", outputStats.CacheRejected)
+
+			targetNames := make([]string, 0, len(outputStats.Targets))
+			for name := range outputStats.Targets {
+				targetNames = append(targetNames, name)
+			}
+			sort.Strings(targetNames)
+			for _, name := range targetNames {
+				target := outputStats.Targets[name]
+				cmd.Printf("Cache target %s:\n", name)
+				cmd.Printf("  Cache hits:                  %d\n", target.CacheHits)
+				cmd.Printf("  Cache misses:                %d\n", target.CacheMisses)
+				cmd.Printf("  Cache errors:                %d\n", target.CacheErrors)
+				cmd.Printf("  Cache additions:             %d\n", target.CacheAdded)
+				cmd.Printf("  Bytes downloaded from cache: %s\n", byteFormatFunc(target.BytesTransferredFromCache))
+				cmd.Printf("  Bytes uploaded to cache:     %s\n\n", byteFormatFunc(target.BytesTransferredToCache))
+			}
+
 			cmd.Printf("Bytes downloaded from remote:  %s\n", byteFormatFunc(outputStats.BytesTransferredFromRemote))
 			cmd.Printf("Bytes downloaded from cache:   %s\n", byteFormatFunc(outputStats.BytesTransferredFromCache))
 			cmd.Printf("Bytes uploaded to remote:      %s\n", byteFormatFunc(outputStats.BytesTransferredToRemote))
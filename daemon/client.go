@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
+)
+
+var _ caching.Backend = (*Client)(nil)
+
+// Client forwards the cache operations of an adapter to the daemon. The
+// results of cache targets are reported to UpdateStats, if set, the same as for
+// a caching.MultiBackend.
+type Client struct {
+	client        *http.Client
+	configuration json.RawMessage
+	enabled       bool
+	storageDir    string
+	UpdateStats   func(update func(s *stats.Stats))
+}
+
+// Dial connects to the daemon listening on the socket, and sets up the cache
+// backend for the configuration in the daemon. It returns nil without an error
+// if no daemon is running.
+func Dial(socket string, configuration []byte, storageDir string) (*Client, error) {
+	if _, err := os.Stat(socket); os.IsNotExist(err) {
+		return nil, nil
+	}
+	client := &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+				MaxIdleConnsPerHost: 64,
+			},
+		},
+		configuration: configuration,
+		storageDir:    storageDir,
+	}
+	response, err := client.do(&request{Event: "init"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	client.enabled = response.Enabled
+	return client, nil
+}
+
+// Enabled returns whether caching is configured, such that the client can be
+// used as cache backend.
+func (c *Client) Enabled() bool {
+	return c.enabled
+}
+
+// do sends the request to the daemon, and returns its complete message. Other
+// messages are passed to the callback.
+func (c *Client) do(req *request, callback func(response *response) error) (*response, error) {
+	req.Configuration = c.configuration
+	req.StorageDir = c.storageDir
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := c.client.Post("http://daemon/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to daemon: %v", err)
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("daemon responded with %s", httpResponse.Status)
+	}
+
+	reader := bufio.NewReader(httpResponse.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response of daemon: %v", err)
+		}
+		var message response
+		if err := json.Unmarshal(line, &message); err != nil {
+			return nil, fmt.Errorf("invalid response of daemon: %v", err)
+		}
+		if message.Event != "complete" {
+			if callback != nil {
+				if err := callback(&message); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		c.updateTargets(message.Targets)
+		if message.Error != nil {
+			return nil, &requestError{message: message.Error.Message, kind: message.Error.Kind}
+		}
+		return &message, nil
+	}
+}
+
+// updateTargets adds the results of cache targets to the session statistics.
+func (c *Client) updateTargets(targets map[string]*stats.TargetStats) {
+	if c.UpdateStats == nil || len(targets) == 0 {
+		return
+	}
+	c.UpdateStats(func(s *stats.Stats) {
+		for name, target := range targets {
+			s.Target(name).Add(target)
+		}
+	})
+}
+
+// SaveStats passes the statistics of the session to the daemon, which writes
+// them together with the statistics of other sessions of the repository.
+func (c *Client) SaveStats(session *stats.Stats) error {
+	_, err := c.do(&request{Event: "stats", Stats: session}, nil)
+	return err
+}
+
+func (c *Client) Exists(oid string, size int64) (bool, error) {
+	response, err := c.do(&request{Event: "exists", Oid: oid, Size: size}, nil)
+	if err != nil {
+		return false, err
+	}
+	return response.Found, nil
+}
+
+func (c *Client) Download(dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	// The daemon runs in another working directory
+	path, err := filepath.Abs(dest)
+	if err != nil {
+		return false, err
+	}
+	response, err := c.do(&request{Event: "get", Oid: oid, Size: size, Path: path}, func(response *response) error {
+		if response.Event == "progress" && progressCallback != nil {
+			progressCallback(response.BytesSoFar, response.BytesSinceLast)
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(dest)
+		return false, err
+	}
+	return response.Found, nil
+}
+
+func (c *Client) Upload(source string, oid string, size int64) (bool, error) {
+	path, err := filepath.Abs(source)
+	if err != nil {
+		return false, err
+	}
+	response, err := c.do(&request{Event: "put", Oid: oid, Size: size, Path: path}, nil)
+	if err != nil {
+		return false, err
+	}
+	return response.Stored, nil
+}
+
+func (c *Client) Delete(oid string) error {
+	_, err := c.do(&request{Event: "delete", Oid: oid}, nil)
+	return err
+}
+
+func (c *Client) List(callback func(object *caching.Object) error) error {
+	_, err := c.do(&request{Event: "list"}, func(response *response) error {
+		if response.Event != "object" {
+			return nil
+		}
+		return callback(&caching.Object{
+			Oid:          response.Oid,
+			Size:         response.Size,
+			LastModified: response.LastModified,
+			StorageClass: response.StorageClass,
+		})
+	})
+	return err
+}
@@ -0,0 +1,283 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/git-lfs/git-lfs/v3/config"
+
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/lfs"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
+)
+
+// statsInterval is how often the statistics passed by adapters are written.
+const statsInterval = time.Minute
+
+// Daemon serves the cache operations of all adapter processes on the machine.
+// Adapters with the same caching configuration share a single cache backend,
+// and thereby its connections, and identical objects that are transferred at
+// the same time are only transferred once. The statistics of all sessions are
+// collected and written per repository by the daemon.
+type Daemon struct {
+	backends      map[string]*sharedBackend
+	backendsMutex sync.Mutex
+	config        *config.Configuration
+	stats         map[string]*stats.Stats
+	statsMutex    sync.Mutex
+	stop          chan struct{}
+	stopped       chan struct{}
+}
+
+// sharedBackend is the cache backend of a single caching configuration, with
+// the transfers that are running on it.
+type sharedBackend struct {
+	backend   caching.Backend
+	downloads map[string]*download
+	err       error
+	mutex     sync.Mutex
+	once      sync.Once
+	uploads   map[string]chan struct{}
+}
+
+// NewDaemon creates a daemon without any cache backends. Backends are set up
+// when the first adapter with their configuration connects.
+func NewDaemon() *Daemon {
+	daemon := &Daemon{
+		backends: make(map[string]*sharedBackend),
+		config:   lfs.GetPassthroughConfiguration(),
+		stats:    make(map[string]*stats.Stats),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go daemon.writeStatsPeriodically()
+	return daemon
+}
+
+// Listen listens on the unix socket at the given path. A socket that is left
+// behind by a daemon that is no longer running is replaced.
+func Listen(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", socket)
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	// Anyone who can connect uses the cache with the credentials of the
+	// daemon, so only the user running the daemon may connect. The socket
+	// is created without permissions for others right away, instead of
+	// restricting them after it was created.
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", socket)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Handler returns the handler for the requests of adapters.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", d.handle)
+	return mux
+}
+
+// Close closes the cache backends, and writes the statistics that were not
+// written yet.
+func (d *Daemon) Close() {
+	close(d.stop)
+	<-d.stopped
+	d.backendsMutex.Lock()
+	for _, shared := range d.backends {
+		if err := caching.CloseBackend(shared.backend); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to close cache backend: %s\n", err.Error())
+		}
+	}
+	d.backendsMutex.Unlock()
+	d.writeStats()
+}
+
+func (d *Daemon) handle(w http.ResponseWriter, r *http.Request) {
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	send := func(response *response) {
+		encoder.Encode(response)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	complete := func(response *response, err error) {
+		response.Event = "complete"
+		if err != nil {
+			response.Error = newErrorMessage(err)
+		}
+		send(response)
+	}
+
+	if req.Event == "stats" {
+		d.addStats(req.StorageDir, req.Stats)
+		complete(&response{}, nil)
+		return
+	}
+
+	shared, err := d.backend(req.Configuration, req.StorageDir)
+	if err != nil {
+		complete(&response{}, err)
+		return
+	}
+	if req.Event == "init" {
+		complete(&response{Enabled: shared.backend != nil}, nil)
+		return
+	}
+	if shared.backend == nil {
+		complete(&response{}, errors.New("caching is not configured"))
+		return
+	}
+
+	// The results of the targets are passed back to the adapter, which
+	// adds them to the statistics of its session.
+	var targets stats.Stats
+	var targetsMutex sync.Mutex
+	backend := shared.backend
+	if multiBackend, ok := backend.(*caching.MultiBackend); ok {
+		backend = multiBackend.WithUpdateStats(func(update func(s *stats.Stats)) {
+			targetsMutex.Lock()
+			defer targetsMutex.Unlock()
+			update(&targets)
+		})
+	}
+
+	switch req.Event {
+	case "exists":
+		found, err := backend.Exists(req.Oid, req.Size)
+		complete(&response{Found: found}, err)
+	case "get":
+		found, err := shared.download(backend, req.Path, req.Oid, req.Size, func(bytesSoFar int64, bytesSinceLast int64) {
+			send(&response{Event: "progress", Oid: req.Oid, BytesSoFar: bytesSoFar, BytesSinceLast: bytesSinceLast})
+		})
+		complete(&response{Found: found, Targets: targets.Targets}, err)
+	case "put":
+		stored, err := shared.upload(backend, req.Path, req.Oid, req.Size)
+		complete(&response{Stored: stored, Targets: targets.Targets}, err)
+	case "delete":
+		complete(&response{}, backend.Delete(req.Oid))
+	case "list":
+		err := backend.List(func(object *caching.Object) error {
+			send(&response{
+				Event:        "object",
+				Oid:          object.Oid,
+				Size:         object.Size,
+				LastModified: object.LastModified,
+				StorageClass: object.StorageClass,
+			})
+			return r.Context().Err()
+		})
+		complete(&response{}, err)
+	default:
+		complete(&response{}, fmt.Errorf("unknown event %q", req.Event))
+	}
+}
+
+// backend returns the shared backend of the configuration, and sets it up if
+// this is the first request with the configuration. Backends that failed to
+// set up are set up again on the next request.
+func (d *Daemon) backend(configuration json.RawMessage, storageDir string) (*sharedBackend, error) {
+	key := string(configuration)
+	d.backendsMutex.Lock()
+	shared, ok := d.backends[key]
+	if !ok {
+		shared = &sharedBackend{
+			downloads: make(map[string]*download),
+			uploads:   make(map[string]chan struct{}),
+		}
+		d.backends[key] = shared
+	}
+	d.backendsMutex.Unlock()
+
+	shared.once.Do(func() {
+		cachingConfiguration, err := caching.DecodeCachingConfiguration(d.config, configuration, storageDir)
+		if err != nil {
+			shared.err = err
+			return
+		}
+		shared.backend, shared.err = caching.NewBackend(cachingConfiguration)
+	})
+	if shared.err != nil {
+		d.backendsMutex.Lock()
+		if d.backends[key] == shared {
+			delete(d.backends, key)
+		}
+		d.backendsMutex.Unlock()
+		return nil, fmt.Errorf("failed to set up cache backend: %v", shared.err)
+	}
+	return shared, nil
+}
+
+// addStats adds the statistics of a finished session to the statistics of its
+// repository, which are written on the next interval.
+func (d *Daemon) addStats(storageDir string, session *stats.Stats) {
+	if storageDir == "" || session == nil {
+		return
+	}
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	collected, ok := d.stats[storageDir]
+	if !ok {
+		collected = &stats.Stats{}
+		d.stats[storageDir] = collected
+	}
+	collected.Add(session)
+}
+
+func (d *Daemon) writeStatsPeriodically() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.writeStats()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// writeStats writes the collected statistics of every repository as a single
+// file, and starts collecting anew.
+func (d *Daemon) writeStats() {
+	d.statsMutex.Lock()
+	collected := d.stats
+	d.stats = make(map[string]*stats.Stats)
+	d.statsMutex.Unlock()
+
+	for storageDir, repositoryStats := range collected {
+		if err := repositoryStats.SaveIn(storageDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed writing stats of %s, ignoring... %s\n", storageDir, err.Error())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
+)
+
+const (
+	// errorKindCorrupt and errorKindInvalid mark errors that wrap
+	// caching.ErrCorruptObject and caching.ErrInvalidObject, such that the
+	// adapter handles them the same as errors of a backend in its own process.
+	errorKindCorrupt = "corrupt"
+	errorKindInvalid = "invalid"
+)
+
+// request is a request of an adapter to the daemon. Requests carry the caching
+// configuration the adapter resolved, such that the daemon uses the same cache
+// backend as the adapter would. Not all fields are filled in on all requests.
+type request struct {
+	Event         string          `json:"event"`
+	Configuration json.RawMessage `json:"configuration,omitempty"`
+	StorageDir    string          `json:"storageDir,omitempty"`
+	Oid           string          `json:"oid,omitempty"`
+	Size          int64           `json:"size,omitempty"`
+	Path          string          `json:"path,omitempty"`
+	Stats         *stats.Stats    `json:"stats,omitempty"`
+}
+
+// response is a message from the daemon. The daemon answers every request with
+// any number of progress or object messages, followed by a single complete
+// message. Not all fields are filled in on all messages.
+type response struct {
+	Event          string                        `json:"event"`
+	Enabled        bool                          `json:"enabled,omitempty"`
+	Found          bool                          `json:"found,omitempty"`
+	Stored         bool                          `json:"stored,omitempty"`
+	Oid            string                        `json:"oid,omitempty"`
+	BytesSoFar     int64                         `json:"bytesSoFar,omitempty"`
+	BytesSinceLast int64                         `json:"bytesSinceLast,omitempty"`
+	Size           int64                         `json:"size,omitempty"`
+	LastModified   time.Time                     `json:"lastModified,omitempty"`
+	StorageClass   string                        `json:"storageClass,omitempty"`
+	Targets        map[string]*stats.TargetStats `json:"targets,omitempty"`
+	Error          *errorMessage                 `json:"error,omitempty"`
+}
+
+// errorMessage is the error of a failed request.
+type errorMessage struct {
+	Message string `json:"message"`
+	Kind    string `json:"kind,omitempty"`
+}
+
+func newErrorMessage(err error) *errorMessage {
+	message := &errorMessage{Message: err.Error()}
+	if errors.Is(err, caching.ErrCorruptObject) {
+		message.Kind = errorKindCorrupt
+	} else if errors.Is(err, caching.ErrInvalidObject) {
+		message.Kind = errorKindInvalid
+	}
+	return message
+}
+
+// requestError is an error returned by the daemon for a request.
+type requestError struct {
+	message string
+	kind    string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func (e *requestError) Unwrap() error {
+	switch e.kind {
+	case errorKindCorrupt:
+		return caching.ErrCorruptObject
+	case errorKindInvalid:
+		return caching.ErrInvalidObject
+	default:
+		return nil
+	}
+}
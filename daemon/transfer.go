@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+)
+
+// download is a download of an object from the cache. Adapters that request the
+// same object while it is downloaded wait for the download, and get a copy of
+// the downloaded file.
+type download struct {
+	bytesSoFar int64
+	copies     sync.WaitGroup
+	done       chan struct{}
+	err        error
+	found      bool
+	listeners  []func(bytesSoFar int64, bytesSinceLast int64)
+	mutex      sync.Mutex
+	path       string
+}
+
+// progress passes the progress of the download to every adapter waiting for it.
+func (d *download) progress(bytesSoFar int64, bytesSinceLast int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.bytesSoFar = bytesSoFar
+	for _, listener := range d.listeners {
+		listener(bytesSoFar, bytesSinceLast)
+	}
+}
+
+// listen adds a listener for the progress of the download, which first gets the
+// progress so far.
+func (d *download) listen(listener func(bytesSoFar int64, bytesSinceLast int64)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.bytesSoFar > 0 {
+		listener(d.bytesSoFar, d.bytesSoFar)
+	}
+	d.listeners = append(d.listeners, listener)
+}
+
+// download downloads the object to dest, or waits for the running download of
+// the object and copies its result to dest.
+func (s *sharedBackend) download(backend caching.Backend, dest string, oid string, size int64, progressCallback func(bytesSoFar int64, bytesSinceLast int64)) (bool, error) {
+	s.mutex.Lock()
+	if running, ok := s.downloads[oid]; ok {
+		running.copies.Add(1)
+		s.mutex.Unlock()
+		defer running.copies.Done()
+
+		fmt.Fprintf(os.Stderr, "Waiting for running download of object %s\n", oid)
+		running.listen(progressCallback)
+		<-running.done
+		if !running.found || running.err != nil {
+			return running.found, running.err
+		}
+		if err := linkOrCopy(running.path, dest); err != nil {
+			return false, fmt.Errorf("failed to copy downloaded object: %v", err)
+		}
+		return true, nil
+	}
+	running := &download{
+		done:      make(chan struct{}),
+		listeners: []func(bytesSoFar int64, bytesSinceLast int64){progressCallback},
+		path:      dest,
+	}
+	s.downloads[oid] = running
+	s.mutex.Unlock()
+
+	running.found, running.err = backend.Download(dest, oid, size, running.progress)
+
+	s.mutex.Lock()
+	delete(s.downloads, oid)
+	s.mutex.Unlock()
+	close(running.done)
+
+	// The adapter moves the file away once it gets the result, so the result
+	// is held back until all waiting adapters have their copy.
+	running.copies.Wait()
+	return running.found, running.err
+}
+
+// upload adds the object at source to the cache. Uploads of an object that is
+// being uploaded already wait for that upload first, such that they usually
+// find the object in the cache instead of uploading it again.
+func (s *sharedBackend) upload(backend caching.Backend, source string, oid string, size int64) (bool, error) {
+	s.mutex.Lock()
+	for {
+		running, ok := s.uploads[oid]
+		if !ok {
+			break
+		}
+		s.mutex.Unlock()
+		fmt.Fprintf(os.Stderr, "Waiting for running upload of object %s\n", oid)
+		<-running
+		s.mutex.Lock()
+	}
+	done := make(chan struct{})
+	s.uploads[oid] = done
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.uploads, oid)
+		s.mutex.Unlock()
+		close(done)
+	}()
+	return backend.Upload(source, oid, size)
+}
+
+// linkOrCopy links the file at source to dest, or copies it if they are on
+// different file systems.
+func linkOrCopy(source string, dest string) error {
+	if err := os.Link(source, dest); err == nil {
+		return nil
+	}
+
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	destFile, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, sourceFile); err != nil {
+		destFile.Close()
+		os.Remove(dest)
+		return err
+	}
+	return destFile.Close()
+}
@@ -1,7 +1,13 @@
 package lfs
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
 	"github.com/git-lfs/git-lfs/v3/config"
+	"github.com/git-lfs/git-lfs/v3/errors"
 	"github.com/git-lfs/git-lfs/v3/git"
 	"github.com/git-lfs/git-lfs/v3/lfsapi"
 	"github.com/git-lfs/git-lfs/v3/tools"
@@ -31,12 +37,8 @@ func NewLFSTransferClient(cfg *config.Configuration, operation string, remote st
 }
 
 func (c *LFSTransferClient) NewTransferQueue(progressCallback tools.CopyCallback) *tq.TransferQueue {
-	tqOperation := tq.Upload
-	if c.operation == "download" {
-		tqOperation = tq.Download
-	}
 	return tq.NewTransferQueue(
-		tqOperation,
+		c.direction(),
 		c.manifest,
 		c.config.Remote(),
 		tq.RemoteRef(currentRemoteRef(c.config, c.remote)),
@@ -45,6 +47,75 @@ func (c *LFSTransferClient) NewTransferQueue(progressCallback tools.CopyCallback
 	)
 }
 
+// Batch requests the transfer actions for all given objects from the upstream
+// LFS API using a single batch request.
+func (c *LFSTransferClient) Batch(transfers []*tq.Transfer) (*tq.BatchResponse, error) {
+	return tq.Batch(c.manifest, c.direction(), c.remote, currentRemoteRef(c.config, c.remote), transfers)
+}
+
+// BeginAdapter creates and starts the transfer adapter with the given name, as
+// returned by the upstream LFS API in a batch response. The adapter can be used
+// for transfers of multiple batches and must be ended by the caller.
+func (c *LFSTransferClient) BeginAdapter(name string, progressCallback tq.ProgressCallback) (tq.Adapter, error) {
+	adapter := c.manifest.NewAdapterOrDefault(name, c.direction())
+	if err := adapter.Begin(c, progressCallback); err != nil {
+		return nil, err
+	}
+	return adapter, nil
+}
+
+// OpenDownload performs the download action of an object returned in a batch
+// response and returns the response body, such that the caller can process the
+// object while it is being downloaded. Requests are made like the basic transfer
+// adapter makes them, including authentication.
+func (c *LFSTransferClient) OpenDownload(object *tq.Transfer) (io.ReadCloser, error) {
+	action, err := object.Rel("download")
+	if err != nil {
+		return nil, err
+	}
+	if action == nil {
+		return nil, fmt.Errorf("object %s not found on the server", object.Oid)
+	}
+
+	req, err := http.NewRequest("GET", action.Href, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range action.Header {
+		req.Header.Set(key, value)
+	}
+	req = c.lfsClient.LogRequest(req, "lfs.data.download")
+
+	var res *http.Response
+	if object.Authenticated {
+		res, err = c.lfsClient.Do(req)
+	} else {
+		endpoint := strings.Split(req.URL.String(), object.Oid)[0]
+		res, err = c.lfsClient.DoWithAuthNoRetry(c.remote, c.lfsClient.Endpoints.AccessFor(endpoint), req)
+	}
+	if err != nil {
+		// Like the basic transfer adapter, consider every failure to be
+		// retriable, unless the server told us when to retry.
+		if _, ok := errors.IsRetriableLaterError(err); ok {
+			return nil, err
+		}
+		return nil, errors.NewRetriableError(err)
+	}
+	return res.Body, nil
+}
+
+func (c *LFSTransferClient) APIClient() *lfsapi.Client {
+	return c.lfsClient
+}
+
+func (c *LFSTransferClient) ConcurrentTransfers() int {
+	return c.manifest.ConcurrentTransfers()
+}
+
+func (c *LFSTransferClient) MaxRetries() int {
+	return c.manifest.MaxRetries()
+}
+
 func (c *LFSTransferClient) Close() error {
 	return c.lfsClient.Close()
 }
@@ -65,6 +136,13 @@ func (c *LFSTransferClient) Remote() string {
 	return c.remote
 }
 
+func (c *LFSTransferClient) direction() tq.Direction {
+	if c.IsDownload() {
+		return tq.Download
+	}
+	return tq.Upload
+}
+
 func getManifest(cfg *config.Configuration, client *lfsapi.Client, operation string, remote string) tq.Manifest {
 	return tq.NewManifest(cfg.Filesystem(), client, operation, remote)
 }
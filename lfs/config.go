@@ -9,11 +9,15 @@ import (
 )
 
 type passthroughEnvironment struct {
-	environment config.Environment
+	environment         config.Environment
+	concurrentTransfers int
 }
 
 func newPassthroughEnvironment(environment config.Environment) config.Environment {
-	return &passthroughEnvironment{environment}
+	return &passthroughEnvironment{
+		environment:         environment,
+		concurrentTransfers: 1,
+	}
 }
 
 func (e *passthroughEnvironment) Get(key string) (string, bool) {
@@ -44,8 +48,8 @@ func (e *passthroughEnvironment) Bool(key string, def bool) bool {
 
 func (e *passthroughEnvironment) Int(key string, def int) int {
 	if key == "lfs.concurrenttransfers" {
-		fmt.Fprintf(os.Stderr, "Call to read %s, intercepting and returning 1\n", key)
-		return 1
+		fmt.Fprintf(os.Stderr, "Call to read %s, intercepting and returning %d\n", key, e.concurrentTransfers)
+		return e.concurrentTransfers
 	}
 	return e.environment.Int(key, def)
 }
@@ -59,3 +63,11 @@ func GetPassthroughConfiguration() *config.Configuration {
 	config.Git = newPassthroughEnvironment(config.Git)
 	return config
 }
+
+// SetConcurrentTransfers changes the value returned for lfs.concurrenttransfers
+// by a configuration obtained from GetPassthroughConfiguration.
+func SetConcurrentTransfers(cfg *config.Configuration, concurrentTransfers int) {
+	if environment, ok := cfg.Git.(*passthroughEnvironment); ok {
+		environment.concurrentTransfers = concurrentTransfers
+	}
+}
@@ -0,0 +1,142 @@
+package s3server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureAlgorithm = "AWS4-HMAC-SHA256"
+	maximumClockSkew   = 15 * time.Minute
+)
+
+var (
+	errAccessDenied      = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errSignatureMismatch = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	errRequestTooSkewed  = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large"}
+)
+
+// authenticate verifies the AWS Signature Version 4 of the request against the
+// static credentials of the server. The payload is verified separately, while
+// it is read.
+func (s *Server) authenticate(r *http.Request) *s3Error {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, signatureAlgorithm+" ") {
+		return errAccessDenied
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, signatureAlgorithm+" "), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[name] = value
+	}
+
+	scope := strings.Split(fields["Credential"], "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" {
+		return errAccessDenied
+	}
+	if scope[0] != s.accessKey {
+		return errAccessDenied
+	}
+
+	date := r.Header.Get("X-Amz-Date")
+	requestTime, err := time.Parse("20060102T150405Z", date)
+	if err != nil || !strings.HasPrefix(date, scope[1]) {
+		return errAccessDenied
+	}
+	if skew := time.Since(requestTime); skew > maximumClockSkew || skew < -maximumClockSkew {
+		return errRequestTooSkewed
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		strings.SplitN(r.RequestURI, "?", 2)[0],
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, signedHeaders),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		signatureAlgorithm,
+		date,
+		strings.Join(scope[1:], "/"),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range scope[1:] {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(fields["Signature"])) {
+		return errSignatureMismatch
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query parameters sorted by name and value, and
+// encoded like AWS encodes them.
+func canonicalQuery(query url.Values) string {
+	var parameters []string
+	for name, values := range query {
+		for _, value := range values {
+			parameters = append(parameters, fmt.Sprintf("%s=%s", awsEscape(name), awsEscape(value)))
+		}
+	}
+	sort.Strings(parameters)
+	return strings.Join(parameters, "&")
+}
+
+// canonicalHeaders returns the signed headers, each followed by a newline. Go
+// moves some headers out of the header map, so they are restored here.
+func canonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		case "transfer-encoding":
+			values = r.TransferEncoding
+		default:
+			values = r.Header.Values(name)
+		}
+		trimmed := make([]string, 0, len(values))
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.Join(trimmed, ","))
+	}
+	return headers.String()
+}
+
+// awsEscape percent-encodes all characters except the unreserved characters of
+// RFC 3986.
+func awsEscape(value string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
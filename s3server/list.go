@@ -0,0 +1,137 @@
+package s3server
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maximumListKeys = 1000
+
+var errInvalidToken = &s3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"}
+
+// listObjects lists the objects in the bucket in the order of their keys, like
+// ListObjectsV2 does. The continuation token is the last key of the previous
+// page, so pages stay consistent while objects are added or removed.
+func (s *Server) listObjects(w http.ResponseWriter, bucket string, query url.Values) error {
+	result := &listBucketResult{
+		Namespace:         s3Namespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           maximumListKeys,
+	}
+	if value := query.Get("max-keys"); value != "" {
+		maxKeys, err := strconv.Atoi(value)
+		if err != nil || maxKeys < 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid max-keys"}
+		}
+		result.MaxKeys = min(maxKeys, maximumListKeys)
+	}
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return errInvalidToken
+		}
+		after = max(after, string(token))
+	}
+
+	objects, err := s.objectsAfter(bucket, result.Prefix, after)
+	if err != nil {
+		return err
+	}
+
+	last := ""
+	for _, object := range objects {
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if result.Delimiter != "" {
+			if i := strings.Index(object.Key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				prefix := object.Key[:len(result.Prefix)+i+len(result.Delimiter)]
+				if len(result.CommonPrefixes) == 0 || result.CommonPrefixes[len(result.CommonPrefixes)-1].Prefix != prefix {
+					result.CommonPrefixes = append(result.CommonPrefixes, &commonPrefix{Prefix: prefix})
+					result.KeyCount++
+				}
+				last = object.Key
+				continue
+			}
+		}
+		result.Contents = append(result.Contents, object)
+		result.KeyCount++
+		last = object.Key
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+
+	writeXML(w, result)
+	return nil
+}
+
+// objectsAfter returns the objects in the bucket with the given prefix and a
+// key after the given key, sorted by key.
+func (s *Server) objectsAfter(bucket string, prefix string, after string) ([]*listObject, error) {
+	bucketRoot := filepath.Join(s.root, bucket)
+	// Only walk the directory the prefix points into.
+	walkRoot := bucketRoot
+	if i := strings.LastIndex(prefix, "/"); i >= 0 && validKey(prefix[:i]) {
+		walkRoot = filepath.Join(bucketRoot, filepath.FromSlash(prefix[:i]))
+	}
+
+	var objects []*listObject
+	err := filepath.WalkDir(walkRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == walkRoot && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		relative, err := filepath.Rel(bucketRoot, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		objects = append(objects, &listObject{
+			Key:          key,
+			LastModified: formatTime(info.ModTime()),
+			ETag:         etag(info),
+			Size:         info.Size(),
+			StorageClass: "STANDARD",
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The order of the walk differs from the order of the keys, as the path
+	// separator does not sort before all other characters.
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
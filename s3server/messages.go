@@ -0,0 +1,77 @@
+package s3server
+
+import "encoding/xml"
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// errorResponse represents the error response of a failed request.
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// listBucketResult represents the response of a ListObjectsV2 request.
+type listBucketResult struct {
+	XMLName               xml.Name        `xml:"ListBucketResult"`
+	Namespace             string          `xml:"xmlns,attr"`
+	Name                  string          `xml:"Name"`
+	Prefix                string          `xml:"Prefix"`
+	Delimiter             string          `xml:"Delimiter,omitempty"`
+	StartAfter            string          `xml:"StartAfter,omitempty"`
+	ContinuationToken     string          `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string          `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int             `xml:"KeyCount"`
+	MaxKeys               int             `xml:"MaxKeys"`
+	IsTruncated           bool            `xml:"IsTruncated"`
+	Contents              []*listObject   `xml:"Contents"`
+	CommonPrefixes        []*commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObject represents an object in the response of a ListObjectsV2 request.
+type listObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// commonPrefix represents the keys that were rolled up by the delimiter in the
+// response of a ListObjectsV2 request.
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// initiateMultipartUploadResult represents the response of a
+// CreateMultipartUpload request.
+type initiateMultipartUploadResult struct {
+	XMLName   xml.Name `xml:"InitiateMultipartUploadResult"`
+	Namespace string   `xml:"xmlns,attr"`
+	Bucket    string   `xml:"Bucket"`
+	Key       string   `xml:"Key"`
+	UploadId  string   `xml:"UploadId"`
+}
+
+// completeMultipartUpload represents the request of a CompleteMultipartUpload
+// request.
+type completeMultipartUpload struct {
+	Parts []*completedPart `xml:"Part"`
+}
+
+// completedPart represents a part in a CompleteMultipartUpload request.
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// completeMultipartUploadResult represents the response of a
+// CompleteMultipartUpload request.
+type completeMultipartUploadResult struct {
+	XMLName   xml.Name `xml:"CompleteMultipartUploadResult"`
+	Namespace string   `xml:"xmlns,attr"`
+	Bucket    string   `xml:"Bucket"`
+	Key       string   `xml:"Key"`
+	ETag      string   `xml:"ETag"`
+}
@@ -0,0 +1,184 @@
+package s3server
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	maximumPartNumber  = 10000
+	minimumPartSize    = 5 * 1024 * 1024
+	uploadTargetFile   = "target"
+	partFileNameFormat = "part-%05d"
+)
+
+var (
+	errEntityTooSmall = &s3Error{http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size"}
+	errInvalidPart    = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	errInvalidOrder   = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errNoSuchUpload   = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+)
+
+// uploadDirectory returns the directory with the parts of the multipart upload,
+// after checking that the upload is for the given object.
+func (s *Server) uploadDirectory(bucket string, key string, uploadId string) (string, error) {
+	if _, err := hex.DecodeString(uploadId); err != nil || uploadId == "" {
+		return "", errNoSuchUpload
+	}
+	directory := filepath.Join(s.root, uploadsDirectory, uploadId)
+	target, err := os.ReadFile(filepath.Join(directory, uploadTargetFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", errNoSuchUpload
+		}
+		return "", err
+	}
+	if string(target) != bucket+"/"+key {
+		return "", errNoSuchUpload
+	}
+	return directory, nil
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, bucket string, key string) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	uploadId := hex.EncodeToString(id)
+	directory := filepath.Join(s.root, uploadsDirectory, uploadId)
+	if err := os.Mkdir(directory, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(directory, uploadTargetFile), []byte(bucket+"/"+key), 0644); err != nil {
+		os.RemoveAll(directory)
+		return err
+	}
+
+	writeXML(w, &initiateMultipartUploadResult{
+		Namespace: s3Namespace,
+		Bucket:    bucket,
+		Key:       key,
+		UploadId:  uploadId,
+	})
+	return nil
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadId string, partNumber string) error {
+	directory, err := s.uploadDirectory(bucket, key, uploadId)
+	if err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(partNumber)
+	if err != nil || number < 1 || number > maximumPartNumber {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive"}
+	}
+
+	payload := newPayload(r)
+	if err := s.writeFile(filepath.Join(directory, fmt.Sprintf(partFileNameFormat, number)), payload); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", payload.etag())
+	w.Header().Set("X-Amz-Checksum-Crc32", payload.checksumCRC32())
+	return nil
+}
+
+// completeMultipartUpload concatenates the listed parts into the object. The
+// ETag of the object is derived from the ETags of the parts, like S3 does.
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string, uploadId string) error {
+	directory, err := s.uploadDirectory(bucket, key, uploadId)
+	if err != nil {
+		return err
+	}
+	var request completeMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Parts) == 0 {
+		return &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema"}
+	}
+
+	file, err := os.CreateTemp(filepath.Join(s.root, temporaryDirectory), "object-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	etags := md5.New()
+	for i, part := range request.Parts {
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			return errInvalidOrder
+		}
+		size, err := appendPart(file, filepath.Join(directory, fmt.Sprintf(partFileNameFormat, part.PartNumber)), part.ETag, etags)
+		if err != nil {
+			return err
+		}
+		if size < minimumPartSize && i < len(request.Parts)-1 {
+			return errEntityTooSmall
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	path := s.path(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	os.RemoveAll(directory)
+
+	writeXML(w, &completeMultipartUploadResult{
+		Namespace: s3Namespace,
+		Bucket:    bucket,
+		Key:       key,
+		ETag:      fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(etags.Sum(nil)), len(request.Parts)),
+	})
+	return nil
+}
+
+// appendPart appends the part to the file, after checking that it is the part
+// with the given ETag. The MD5 of the part is added to etags.
+func appendPart(file *os.File, path string, etag string, etags io.Writer) (int64, error) {
+	part, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, errInvalidPart
+		}
+		return 0, err
+	}
+	defer part.Close()
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), part)
+	if err != nil {
+		return 0, err
+	}
+	sum := hash.Sum(nil)
+	if hex.EncodeToString(sum) != strings.Trim(etag, "\"") {
+		return 0, errInvalidPart
+	}
+	etags.Write(sum)
+	return size, nil
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, bucket string, key string, uploadId string) error {
+	directory, err := s.uploadDirectory(bucket, key, uploadId)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(directory); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,172 @@
+package s3server
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// payload reads the body of a request that uploads data, and verifies it once
+// it is read completely. Bodies in the aws-chunked encoding are decoded. Their
+// chunk signatures are not verified, but the signature of the request is.
+type payload struct {
+	chunked        *chunkedReader
+	crc32          hash.Hash32
+	expectedCRC32  string
+	expectedSHA256 string
+	expectedSize   int64
+	md5            hash.Hash
+	reader         io.Reader
+	sha256         hash.Hash
+	size           int64
+}
+
+func newPayload(r *http.Request) *payload {
+	p := &payload{
+		crc32:         crc32.NewIEEE(),
+		expectedCRC32: r.Header.Get("X-Amz-Checksum-Crc32"),
+		expectedSize:  r.ContentLength,
+		md5:           md5.New(),
+		sha256:        sha256.New(),
+	}
+	contentSHA256 := r.Header.Get("X-Amz-Content-Sha256")
+	if strings.HasPrefix(contentSHA256, "STREAMING-") {
+		p.chunked = &chunkedReader{reader: bufio.NewReader(r.Body)}
+		p.reader = p.chunked
+		p.expectedSize = -1
+		if value := r.Header.Get("X-Amz-Decoded-Content-Length"); value != "" {
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+				p.expectedSize = size
+			}
+		}
+	} else {
+		p.reader = r.Body
+		if len(contentSHA256) == sha256.Size*2 {
+			p.expectedSHA256 = contentSHA256
+		}
+	}
+	return p
+}
+
+func (p *payload) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.size += int64(n)
+	p.crc32.Write(b[:n])
+	p.md5.Write(b[:n])
+	p.sha256.Write(b[:n])
+	return n, err
+}
+
+// verify checks the payload against the size and checksums of the request,
+// once it is read completely.
+func (p *payload) verify() *s3Error {
+	if p.expectedSize >= 0 && p.size != p.expectedSize {
+		return &s3Error{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header"}
+	}
+	if p.expectedSHA256 != "" && hex.EncodeToString(p.sha256.Sum(nil)) != p.expectedSHA256 {
+		return &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	}
+	expectedCRC32 := p.expectedCRC32
+	if p.chunked != nil && p.chunked.trailer.Get("X-Amz-Checksum-Crc32") != "" {
+		expectedCRC32 = p.chunked.trailer.Get("X-Amz-Checksum-Crc32")
+	}
+	if expectedCRC32 != "" && expectedCRC32 != p.checksumCRC32() {
+		return &s3Error{http.StatusBadRequest, "BadDigest", "The CRC32 you specified did not match the calculated checksum"}
+	}
+	return nil
+}
+
+// checksumCRC32 returns the CRC32 checksum of the payload, encoded like S3
+// encodes it.
+func (p *payload) checksumCRC32() string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, p.crc32.Sum32()))
+}
+
+// etag returns the ETag of an object with the payload as contents.
+func (p *payload) etag() string {
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(p.md5.Sum(nil)))
+}
+
+// chunkedReader decodes a body in the aws-chunked encoding. Every chunk starts
+// with a line with its size in hexadecimal, optionally followed by extensions
+// such as its signature. The last chunk is empty, and followed by the trailing
+// headers, if any.
+type chunkedReader struct {
+	done      bool
+	reader    *bufio.Reader
+	remaining int64
+	trailer   http.Header
+}
+
+func (c *chunkedReader) Read(b []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		line, err := c.readLine()
+		if err != nil {
+			return 0, err
+		}
+		size, _, _ := strings.Cut(line, ";")
+		c.remaining, err = strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || c.remaining < 0 {
+			return 0, fmt.Errorf("invalid chunk size %q", size)
+		}
+		if c.remaining == 0 {
+			return 0, c.readTrailer()
+		}
+	}
+
+	n, err := c.reader.Read(b[:min(int64(len(b)), c.remaining)])
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == nil && c.remaining == 0 {
+		if line, lineErr := c.readLine(); lineErr != nil || line != "" {
+			err = fmt.Errorf("chunk is larger than announced")
+		}
+	}
+	return n, err
+}
+
+func (c *chunkedReader) readTrailer() error {
+	c.trailer = make(http.Header)
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			c.done = true
+			return io.EOF
+		}
+		name, value, _ := strings.Cut(line, ":")
+		c.trailer.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err == io.EOF {
+		// The final empty line of the trailer is optional in practice.
+		if line == "" && c.trailer != nil {
+			return "", nil
+		}
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
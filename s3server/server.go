@@ -0,0 +1,254 @@
+package s3server
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// temporaryDirectory holds files that are being written, and
+	// uploadsDirectory holds the parts of multipart uploads. Both are hidden,
+	// such that they are never mistaken for buckets.
+	temporaryDirectory = ".tmp"
+	uploadsDirectory   = ".uploads"
+)
+
+// s3Error is an error that is returned to the client with the given status and
+// S3 error code.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+var (
+	errInvalidBucket  = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"}
+	errInvalidKey     = &s3Error{http.StatusBadRequest, "InvalidArgument", "The specified key is not supported by this server"}
+	errNoSuchBucket   = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey      = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errNotImplemented = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+)
+
+// Server exposes a directory through the subset of the S3 API that the caching
+// adapter uses. Every directory in it is a bucket, and objects are stored as
+// files below their bucket, using the key as path. Requests must use path style
+// addressing, and be signed with the static credentials of the server.
+type Server struct {
+	accessKey string
+	root      string
+	secretKey string
+}
+
+// NewServer creates a server for the given directory, and creates the given
+// buckets in it if they do not exist yet.
+func NewServer(root string, accessKey string, secretKey string, buckets []string) (*Server, error) {
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("no credentials configured")
+	}
+	for _, directory := range []string{root, filepath.Join(root, temporaryDirectory), filepath.Join(root, uploadsDirectory)} {
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %v", err)
+		}
+	}
+	for _, bucket := range buckets {
+		if !validBucket(bucket) {
+			return nil, fmt.Errorf("invalid bucket name %q", bucket)
+		}
+		if err := os.MkdirAll(filepath.Join(root, bucket), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %v", bucket, err)
+		}
+	}
+	return &Server{
+		accessKey: accessKey,
+		root:      root,
+		secretKey: secretKey,
+	}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.authenticate(r); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		writeError(w, r, errNotImplemented)
+		return
+	}
+	if !validBucket(bucket) {
+		writeError(w, r, errInvalidBucket)
+		return
+	}
+	if info, err := os.Stat(filepath.Join(s.root, bucket)); err != nil || !info.IsDir() {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+
+	var err error
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		// HeadBucket only checks whether the bucket exists.
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		err = s.listObjects(w, bucket, query)
+	case key == "":
+		err = errNotImplemented
+	case !validKey(key):
+		err = errInvalidKey
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		err = s.createMultipartUpload(w, bucket, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		err = s.completeMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		err = s.uploadPart(w, r, bucket, key, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		err = s.abortMultipartUpload(w, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		err = s.getObject(w, r, bucket, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") == "":
+		err = s.putObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		err = s.deleteObject(w, bucket, key)
+	default:
+		err = errNotImplemented
+	}
+	if err != nil {
+		writeError(w, r, err)
+	}
+}
+
+func (s *Server) path(bucket string, key string) string {
+	return filepath.Join(s.root, bucket, filepath.FromSlash(key))
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket string, key string) error {
+	file, err := os.Open(s.path(bucket, key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return errNoSuchKey
+		}
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errNoSuchKey
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", etag(info))
+	http.ServeContent(w, r, "", info.ModTime(), file)
+	return nil
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket string, key string) error {
+	payload := newPayload(r)
+	if err := s.writeFile(s.path(bucket, key), payload); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", payload.etag())
+	w.Header().Set("X-Amz-Checksum-Crc32", payload.checksumCRC32())
+	return nil
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, bucket string, key string) error {
+	if err := os.Remove(s.path(bucket, key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// writeFile writes the payload to a temporary file first, and only moves it in
+// place once it is verified, such that readers never see incomplete objects.
+func (s *Server) writeFile(path string, payload *payload) error {
+	file, err := os.CreateTemp(filepath.Join(s.root, temporaryDirectory), "object-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(file, payload); err != nil {
+		return &s3Error{http.StatusBadRequest, "IncompleteBody", err.Error()}
+	}
+	if err := payload.verify(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// validBucket returns whether the name can be used as a bucket, without
+// referring to the hidden directories of the server or outside of it.
+func validBucket(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\")
+}
+
+// validKey returns whether the key can be stored as a file below the bucket.
+func validKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.Contains(segment, "\\") {
+			return false
+		}
+	}
+	return true
+}
+
+// etag returns an ETag for a stored object, which changes when it is replaced.
+func etag(info fs.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+func writeXML(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(response)
+}
+
+// writeError responds with the error, like S3 does. Errors that did not come
+// from the S3 API itself are internal errors.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	if !errors.As(err, &s3Err) {
+		fmt.Fprintf(os.Stderr, "Failed to handle %s %s: %v\n", r.Method, r.URL.Path, err)
+		s3Err = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(s3Err.status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(&errorResponse{
+		Code:     s3Err.code,
+		Message:  s3Err.message,
+		Resource: r.URL.Path,
+	})
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
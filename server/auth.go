@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ReadCredentials reads the credentials clients may authenticate with from a
+// file, with a username and password separated by a colon on every line. Empty
+// lines and lines starting with # are ignored.
+func ReadCredentials(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credentials file: %v", err)
+	}
+	defer file.Close()
+
+	credentials := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" || password == "" {
+			return nil, fmt.Errorf("invalid credentials on line %d of %s, expected username:password", number, path)
+		}
+		credentials[username] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("no credentials in %s", path)
+	}
+	return credentials, nil
+}
+
+// IsLoopback returns whether the address only listens on the loopback
+// interface, such that only clients on the same machine can connect.
+func IsLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authenticate only passes requests with valid basic authentication to next,
+// unless no credentials are configured.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if s.credentials == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || !s.validCredentials(username, password) {
+			w.Header().Set("LFS-Authenticate", `Basic realm="Git LFS"`)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Git LFS"`)
+			writeError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validCredentials compares the password in constant time, such that it cannot
+// be guessed from the time the comparison takes.
+func (s *Server) validCredentials(username string, password string) bool {
+	expected, ok := s.credentials[username]
+	if !ok {
+		return false
+	}
+	given := sha256.Sum256([]byte(password))
+	wanted := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(given[:], wanted[:]) == 1
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/git-lfs/git-lfs/v3/tq"
+
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
+)
+
+// fetch is a download of an object from upstream. Concurrent requests for the
+// same object share a single fetch, and the downloaded file is kept until the
+// last of them, and adding the object to the cache, are done with it. The
+// download itself uses the fetch as well, such that it runs to completion and
+// is cleaned up when all requests went away in the meantime.
+type fetch struct {
+	done   chan struct{}
+	err    error
+	path   string
+	status int
+	users  int
+}
+
+// startFetch returns the running fetch of the object, or starts a new one. The
+// fetch must be released by the caller.
+func (s *Server) startFetch(oid string, size int64) *fetch {
+	s.fetchesMutex.Lock()
+	defer s.fetchesMutex.Unlock()
+	if running, ok := s.fetches[oid]; ok {
+		running.users++
+		return running
+	}
+
+	// Used by the caller, and by the download until it is added to the cache
+	fetch := &fetch{done: make(chan struct{}), users: 2}
+	s.fetches[oid] = fetch
+	go func() {
+		fetch.path, fetch.status, fetch.err = s.fetchUpstream(oid, size)
+		close(fetch.done)
+		if fetch.err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to download object %s from upstream: %s\n", oid, fetch.err.Error())
+			s.releaseFetch(oid, fetch)
+			return
+		}
+		if s.backend == nil {
+			s.releaseFetch(oid, fetch)
+			return
+		}
+		s.uploads.Add(1)
+		go s.addToCache(oid, size, fetch)
+	}()
+	return fetch
+}
+
+// releaseFetch removes the fetch and its file once nobody uses it anymore.
+func (s *Server) releaseFetch(oid string, fetch *fetch) {
+	s.fetchesMutex.Lock()
+	defer s.fetchesMutex.Unlock()
+	fetch.users--
+	if fetch.users > 0 {
+		return
+	}
+	delete(s.fetches, oid)
+	if fetch.path != "" {
+		os.Remove(fetch.path)
+	}
+}
+
+// fetchUpstream downloads the object from upstream into a temporary file, and
+// verifies it. On failure, it returns the HTTP status to respond with.
+func (s *Server) fetchUpstream(oid string, size int64) (string, int, error) {
+	fmt.Fprintf(os.Stderr, "Downloading object %s from upstream\n", oid)
+	response, err := s.client.Batch([]*tq.Transfer{{Oid: oid, Size: size}})
+	if err != nil {
+		return "", http.StatusBadGateway, fmt.Errorf("upstream batch request failed: %v", err)
+	}
+	var object *tq.Transfer
+	for _, result := range response.Objects {
+		if result.Oid == oid {
+			object = result
+		}
+	}
+	if object == nil {
+		return "", http.StatusNotFound, fmt.Errorf("object %s is not available upstream", oid)
+	}
+	if object.Error != nil {
+		status := http.StatusBadGateway
+		if object.Error.Code == http.StatusNotFound {
+			status = http.StatusNotFound
+		}
+		return "", status, fmt.Errorf("upstream failed to provide object %s: %s", oid, object.Error.Message)
+	}
+
+	body, err := s.client.OpenDownload(object)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	defer body.Close()
+
+	file, err := os.CreateTemp(s.tempdir, "upstream")
+	if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, hash), body)
+	if err == nil && written != size {
+		err = fmt.Errorf("expected %d bytes for object %s, got %d", size, oid, written)
+	} else if actual := hex.EncodeToString(hash.Sum(nil)); err == nil && actual != oid {
+		err = fmt.Errorf("expected OID %s, got %s after %d bytes written", oid, actual, written)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", http.StatusBadGateway, err
+	}
+
+	s.updateStats(func(s *stats.Stats) {
+		s.BytesTransferredFromRemote += uint64(size)
+	})
+	return file.Name(), 0, nil
+}
+
+// addToCache uploads the fetched object to the cache, and releases the fetch
+// afterwards.
+func (s *Server) addToCache(oid string, size int64, fetch *fetch) {
+	defer s.uploads.Done()
+	defer s.releaseFetch(oid, fetch)
+
+	fmt.Fprintf(os.Stderr, "Adding object %s to cache\n", oid)
+	uploaded, err := s.backend.Upload(fetch.path, oid, size)
+	if uploaded {
+		s.updateStats(func(s *stats.Stats) {
+			s.CacheAddedDuringPull++
+			s.BytesTransferredToCache += uint64(size)
+		})
+		fmt.Fprintf(os.Stderr, "Added object %s to cache\n", oid)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while adding object %s to cache. %s Object is not cached for next download.\n", oid, err.Error())
+	} else {
+		fmt.Fprintf(os.Stderr, "Object %s is already in cache\n", oid)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+// batchRequest represents a request to the Git LFS batch API. The ref and the
+// list of transfer adapters of the client are ignored, as the server only
+// offers basic downloads.
+type batchRequest struct {
+	Operation string         `json:"operation"`
+	Objects   []*batchObject `json:"objects"`
+	HashAlgo  string         `json:"hash_algo,omitempty"`
+}
+
+// batchObject represents an object in a batch request.
+type batchObject struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// batchResponse represents a response of the Git LFS batch API.
+type batchResponse struct {
+	Transfer string                 `json:"transfer"`
+	Objects  []*batchResponseObject `json:"objects"`
+	HashAlgo string                 `json:"hash_algo"`
+}
+
+// batchResponseObject represents an object in a batch response. Either the
+// download action or an error is set.
+type batchResponseObject struct {
+	Oid           string                  `json:"oid"`
+	Size          int64                   `json:"size"`
+	Authenticated bool                    `json:"authenticated,omitempty"`
+	Actions       map[string]*batchAction `json:"actions,omitempty"`
+	Error         *objectError            `json:"error,omitempty"`
+}
+
+// batchAction represents the action to perform to transfer an object. The
+// header holds the authorization of the batch request, if any, such that the
+// download is authenticated the same way.
+type batchAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+// objectError represents the error of a single object in a batch response.
+type objectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorResponse represents the error response of a failed request.
+type errorResponse struct {
+	Message string `json:"message"`
+}
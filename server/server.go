@@ -0,0 +1,353 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/git-lfs/git-lfs/v3/tq"
+
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/caching"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/lfs"
+	"gitlab.heliumnet.nl/toolbox/git-lfs-s3-caching-adapter/stats"
+)
+
+const mediaType = "application/vnd.git-lfs+json"
+
+var oidPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Server implements the Git LFS batch API for downloads in front of the
+// upstream LFS server of the repository it runs in. Objects are served from the
+// cache if possible. Objects missing from the cache are downloaded from
+// upstream, and added to the cache for the next request.
+type Server struct {
+	backend      caching.Backend
+	baseURL      string
+	cacheOnly    bool
+	client       *lfs.LFSTransferClient
+	concurrency  int
+	credentials  map[string]string
+	fetches      map[string]*fetch
+	fetchesMutex sync.Mutex
+	stats        *stats.Stats
+	statsMutex   sync.Mutex
+	tempdir      string
+	uploads      sync.WaitGroup
+}
+
+// NewServer creates a server for the upstream LFS server of the given remote.
+// The download links in batch responses point to baseURL, or to the address
+// the batch request was sent to if baseURL is empty. If credentials are given,
+// clients must authenticate with one of them using basic authentication.
+func NewServer(remote string, baseURL string, credentials map[string]string) (*Server, error) {
+	config := lfs.GetPassthroughConfiguration()
+	if !config.InRepo() {
+		return nil, errors.New("not in a git repository")
+	}
+	cachingConfiguration := caching.GetCachingConfiguration(config)
+
+	storageDir := config.Filesystem().LFSStorageDir
+	if err := os.MkdirAll(storageDir, 0755); err != nil {
+		return nil, err
+	}
+	tempdir, err := os.MkdirTemp(storageDir, "lfs-caching-server-*")
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := lfs.NewLFSTransferClient(config, "download", remote)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := caching.NewBackend(cachingConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		backend:     backend,
+		baseURL:     baseURL,
+		cacheOnly:   cachingConfiguration.CacheOnly(),
+		client:      client,
+		concurrency: cachingConfiguration.ConcurrentTransfers(),
+		credentials: credentials,
+		fetches:     make(map[string]*fetch),
+		stats:       stats.NewSessionStats(),
+		tempdir:     tempdir,
+	}
+	if multiBackend, ok := backend.(*caching.MultiBackend); ok {
+		multiBackend.UpdateStats = server.updateStats
+	}
+	return server, nil
+}
+
+// Handler returns the handler for the requests of Git LFS clients.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /objects/batch", s.batch)
+	mux.HandleFunc("GET /objects/{oid}/{size}", s.download)
+	return s.authenticate(mux)
+}
+
+// Close waits for objects that are still being added to the cache, closes the
+// cache backend and writes the statistics of the server.
+func (s *Server) Close() error {
+	fmt.Fprintf(os.Stderr, "Waiting for objects to be added to cache\n")
+	s.uploads.Wait()
+	os.RemoveAll(s.tempdir)
+	if err := caching.CloseBackend(s.backend); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to close cache backend: %s\n", err.Error())
+	}
+
+	s.statsMutex.Lock()
+	err := s.stats.Save()
+	s.statsMutex.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed writing stats, ignoring...\n")
+	}
+	return s.client.Close()
+}
+
+func (s *Server) updateStats(update func(s *stats.Stats)) {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+	update(s.stats)
+}
+
+// batch answers a batch request with links to the server for all objects that
+// are in the cache or available upstream.
+func (s *Server) batch(w http.ResponseWriter, r *http.Request) {
+	var request batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Invalid batch request: %v", err))
+		return
+	}
+	if request.Operation != "download" {
+		writeError(w, http.StatusForbidden, "This server only serves downloads. Push to the upstream LFS server instead, e.g. by setting lfs.pushurl.")
+		return
+	}
+	if request.HashAlgo != "" && request.HashAlgo != "sha256" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("Unsupported hash algorithm %q", request.HashAlgo))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Received batch request for %d object(s)\n", len(request.Objects))
+
+	objects := make([]*batchResponseObject, 0, len(request.Objects))
+	for _, requested := range request.Objects {
+		object := &batchResponseObject{Oid: requested.Oid, Size: requested.Size}
+		if !oidPattern.MatchString(object.Oid) || object.Size < 0 {
+			object.Error = &objectError{Code: http.StatusUnprocessableEntity, Message: "Invalid object"}
+		}
+		objects = append(objects, object)
+	}
+	var missing []*batchResponseObject
+	for _, object := range s.missingFromCache(objects) {
+		if s.cacheOnly {
+			object.Error = &objectError{Code: http.StatusNotFound, Message: "Object is not available in the cache"}
+			continue
+		}
+		missing = append(missing, object)
+	}
+	if err := s.checkUpstream(missing); err != nil {
+		fmt.Fprintf(os.Stderr, "Upstream batch request failed: %s\n", err.Error())
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("Upstream batch request failed: %v", err))
+		return
+	}
+
+	baseURL := s.baseURL
+	if baseURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		baseURL = fmt.Sprintf("%s://%s", scheme, r.Host)
+	}
+	for _, object := range objects {
+		if object.Error != nil {
+			continue
+		}
+		object.Authenticated = true
+		action := &batchAction{Href: fmt.Sprintf("%s/objects/%s/%d", baseURL, object.Oid, object.Size)}
+		if authorization := r.Header.Get("Authorization"); authorization != "" {
+			action.Header = map[string]string{"Authorization": authorization}
+		}
+		object.Actions = map[string]*batchAction{"download": action}
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	json.NewEncoder(w).Encode(&batchResponse{
+		Transfer: "basic",
+		Objects:  objects,
+		HashAlgo: "sha256",
+	})
+}
+
+// missingFromCache returns the valid objects that are not in the cache. The
+// cache is checked for multiple objects at the same time.
+func (s *Server) missingFromCache(objects []*batchResponseObject) []*batchResponseObject {
+	var missing []*batchResponseObject
+	var mutex sync.Mutex
+	var checks sync.WaitGroup
+	slots := make(chan struct{}, s.concurrency)
+	for _, object := range objects {
+		if object.Error != nil {
+			continue
+		}
+		if s.backend == nil {
+			missing = append(missing, object)
+			continue
+		}
+		slots <- struct{}{}
+		checks.Add(1)
+		go func(object *batchResponseObject) {
+			defer func() {
+				<-slots
+				checks.Done()
+			}()
+			exists, err := s.backend.Exists(object.Oid, object.Size)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cache error while checking object %s. %s\n", object.Oid, err.Error())
+			}
+			if !exists {
+				mutex.Lock()
+				missing = append(missing, object)
+				mutex.Unlock()
+			}
+		}(object)
+	}
+	checks.Wait()
+	return missing
+}
+
+// checkUpstream requests the download actions for the objects from upstream in
+// a single batch request, and sets the error of the objects that upstream
+// cannot provide.
+func (s *Server) checkUpstream(objects []*batchResponseObject) error {
+	if len(objects) == 0 {
+		return nil
+	}
+	transfers := make([]*tq.Transfer, 0, len(objects))
+	for _, object := range objects {
+		transfers = append(transfers, &tq.Transfer{Oid: object.Oid, Size: object.Size})
+	}
+	response, err := s.client.Batch(transfers)
+	if err != nil {
+		return err
+	}
+
+	results := make(map[string]*tq.Transfer, len(response.Objects))
+	for _, result := range response.Objects {
+		results[result.Oid] = result
+	}
+	for _, object := range objects {
+		result, ok := results[object.Oid]
+		if !ok {
+			object.Error = &objectError{Code: http.StatusNotFound, Message: "Object is not available upstream"}
+		} else if result.Error != nil {
+			object.Error = &objectError{Code: result.Error.Code, Message: result.Error.Message}
+		} else if action, err := result.Rel("download"); err != nil || action == nil {
+			object.Error = &objectError{Code: http.StatusNotFound, Message: "Object does not exist upstream"}
+		}
+	}
+	return nil
+}
+
+// download serves the object from the cache, or from upstream if it is missing
+// from the cache.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	oid := r.PathValue("oid")
+	size, err := strconv.ParseInt(r.PathValue("size"), 10, 64)
+	if !oidPattern.MatchString(oid) || err != nil || size < 0 {
+		writeError(w, http.StatusNotFound, "Object not found")
+		return
+	}
+
+	if s.serveFromCache(w, r, oid, size) {
+		return
+	}
+	if s.cacheOnly {
+		s.updateStats(func(s *stats.Stats) { s.CacheOnlyRefusals++ })
+		fmt.Fprintf(os.Stderr, "Refusing to download object %s from upstream in cache-only mode\n", oid)
+		writeError(w, http.StatusNotFound, "Object is not available in the cache")
+		return
+	}
+
+	upstream := s.startFetch(oid, size)
+	defer s.releaseFetch(oid, upstream)
+	select {
+	case <-upstream.done:
+	case <-r.Context().Done():
+		// The download continues for the other requests and the cache
+		fmt.Fprintf(os.Stderr, "Client stopped waiting for object %s from upstream\n", oid)
+		return
+	}
+	if upstream.err != nil {
+		writeError(w, upstream.status, upstream.err.Error())
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Serving object %s from upstream\n", oid)
+	s.serveFile(w, r, upstream.path)
+	s.updateStats(func(s *stats.Stats) { s.ObjectsPulled++ })
+}
+
+// serveFromCache serves the object if it is in the cache, and returns whether
+// it did so.
+func (s *Server) serveFromCache(w http.ResponseWriter, r *http.Request, oid string, size int64) bool {
+	if s.backend == nil {
+		return false
+	}
+	tmp, err := os.CreateTemp(s.tempdir, "download")
+	if err != nil {
+		return false
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	ok, err := s.backend.Download(tmp.Name(), oid, size, nil)
+	if ok {
+		s.updateStats(func(s *stats.Stats) {
+			s.ObjectsPulled++
+			s.CacheHits++
+			s.BytesTransferredFromCache += uint64(size)
+		})
+		fmt.Fprintf(os.Stderr, "Serving object %s from cache\n", oid)
+		s.serveFile(w, r, tmp.Name())
+		return true
+	} else if err == nil {
+		s.updateStats(func(s *stats.Stats) { s.CacheMisses++ })
+		fmt.Fprintf(os.Stderr, "Cache miss for object %s. Will download upstream instead.\n", oid)
+	} else if errors.Is(err, caching.ErrCorruptObject) {
+		s.updateStats(func(s *stats.Stats) { s.CacheCorrupted++ })
+		fmt.Fprintf(os.Stderr, "Corrupt object %s in cache. %s Will download upstream instead.\n", oid, err.Error())
+	} else {
+		s.updateStats(func(s *stats.Stats) { s.CacheErrors++ })
+		fmt.Fprintf(os.Stderr, "Cache error while obtaining object %s. %s Will download upstream instead.\n", oid, err.Error())
+	}
+	return false
+}
+
+// serveFile serves the object in the file, including range requests such that
+// interrupted downloads can be resumed.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to open object: %v", err))
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&errorResponse{Message: message})
+}
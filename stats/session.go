@@ -8,20 +8,37 @@ import (
 )
 
 type Stats struct {
-	name                       string `json:"-"`
-	ObjectsPulled              uint64 `json:"objects_pulled"`
-	ObjectsPushed              uint64 `json:"objects_pushed"`
-	CacheHits                  uint64 `json:"cache_hits"`
-	CacheMisses                uint64 `json:"cache_misses"`
-	CacheErrors                uint64 `json:"cache_errors"`
-	CacheAddedDuringPull       uint64 `json:"cache_added_during_pull"`
-	CacheAddedDuringPush       uint64 `json:"cache_added_during_push"`
-	BytesTransferredFromCache  uint64 `json:"bytes_transferred_from_cache"`
-	BytesTransferredToCache    uint64 `json:"bytes_transferred_to_cache"`
-	BytesTransferredFromRemote uint64 `json:"bytes_transferred_from_remote"`
-	BytesTransferredToRemote   uint64 `json:"bytes_transferred_to_remote"`
-	Sessions                   uint64 `json:"sessions"`
-	Marked                     bool   `json:"marked"`
+	name                       string                  `json:"-"`
+	ObjectsPulled              uint64                  `json:"objects_pulled"`
+	ObjectsPushed              uint64                  `json:"objects_pushed"`
+	CacheHits                  uint64                  `json:"cache_hits"`
+	CacheMisses                uint64                  `json:"cache_misses"`
+	LocalCacheHits             uint64                  `json:"local_cache_hits"`
+	LocalCacheMisses           uint64                  `json:"local_cache_misses"`
+	CacheErrors                uint64                  `json:"cache_errors"`
+	CacheOnlyRefusals          uint64                  `json:"cache_only_refusals"`
+	CacheCorrupted             uint64                  `json:"cache_corrupted"`
+	CacheRejected              uint64                  `json:"cache_rejected"`
+	CacheAddedDuringPull       uint64                  `json:"cache_added_during_pull"`
+	CacheAddedDuringPush       uint64                  `json:"cache_added_during_push"`
+	BytesTransferredFromCache  uint64                  `json:"bytes_transferred_from_cache"`
+	BytesTransferredToCache    uint64                  `json:"bytes_transferred_to_cache"`
+	BytesTransferredFromRemote uint64                  `json:"bytes_transferred_from_remote"`
+	BytesTransferredToRemote   uint64                  `json:"bytes_transferred_to_remote"`
+	Sessions                   uint64                  `json:"sessions"`
+	Targets                    map[string]*TargetStats `json:"targets,omitempty"`
+	Marked                     bool                    `json:"marked"`
+}
+
+// TargetStats are the statistics of a single cache target, when multiple cache
+// targets are configured.
+type TargetStats struct {
+	CacheHits                 uint64 `json:"cache_hits"`
+	CacheMisses               uint64 `json:"cache_misses"`
+	CacheErrors               uint64 `json:"cache_errors"`
+	CacheAdded                uint64 `json:"cache_added"`
+	BytesTransferredFromCache uint64 `json:"bytes_transferred_from_cache"`
+	BytesTransferredToCache   uint64 `json:"bytes_transferred_to_cache"`
 }
 
 func newStats() *Stats {
@@ -31,7 +48,12 @@ func newStats() *Stats {
 		ObjectsPushed:              0,
 		CacheHits:                  0,
 		CacheMisses:                0,
+		LocalCacheHits:             0,
+		LocalCacheMisses:           0,
 		CacheErrors:                0,
+		CacheOnlyRefusals:          0,
+		CacheCorrupted:             0,
+		CacheRejected:              0,
 		CacheAddedDuringPull:       0,
 		CacheAddedDuringPush:       0,
 		BytesTransferredFromCache:  0,
@@ -39,6 +61,7 @@ func newStats() *Stats {
 		BytesTransferredFromRemote: 0,
 		BytesTransferredToRemote:   0,
 		Sessions:                   0,
+		Targets:                    nil,
 		Marked:                     false,
 	}
 }
@@ -63,7 +86,12 @@ func (s *Stats) Add(other *Stats) {
 	s.ObjectsPushed += other.ObjectsPushed
 	s.CacheHits += other.CacheHits
 	s.CacheMisses += other.CacheMisses
+	s.LocalCacheHits += other.LocalCacheHits
+	s.LocalCacheMisses += other.LocalCacheMisses
 	s.CacheErrors += other.CacheErrors
+	s.CacheOnlyRefusals += other.CacheOnlyRefusals
+	s.CacheCorrupted += other.CacheCorrupted
+	s.CacheRejected += other.CacheRejected
 	s.CacheAddedDuringPull += other.CacheAddedDuringPull
 	s.CacheAddedDuringPush += other.CacheAddedDuringPush
 	s.BytesTransferredFromCache += other.BytesTransferredFromCache
@@ -71,6 +99,41 @@ func (s *Stats) Add(other *Stats) {
 	s.BytesTransferredFromRemote += other.BytesTransferredFromRemote
 	s.BytesTransferredToRemote += other.BytesTransferredToRemote
 	s.Sessions += other.Sessions
+	for name, target := range other.Targets {
+		s.Target(name).Add(target)
+	}
+}
+
+// Copy returns a copy of the statistics, which is saved under the same name.
+func (s *Stats) Copy() *Stats {
+	copied := *s
+	copied.Targets = nil
+	for name, target := range s.Targets {
+		copied.Target(name).Add(target)
+	}
+	return &copied
+}
+
+// Target returns the statistics of the cache target with the given name.
+func (s *Stats) Target(name string) *TargetStats {
+	if s.Targets == nil {
+		s.Targets = make(map[string]*TargetStats)
+	}
+	target, ok := s.Targets[name]
+	if !ok {
+		target = &TargetStats{}
+		s.Targets[name] = target
+	}
+	return target
+}
+
+func (s *TargetStats) Add(other *TargetStats) {
+	s.CacheHits += other.CacheHits
+	s.CacheMisses += other.CacheMisses
+	s.CacheErrors += other.CacheErrors
+	s.CacheAdded += other.CacheAdded
+	s.BytesTransferredFromCache += other.BytesTransferredFromCache
+	s.BytesTransferredToCache += other.BytesTransferredToCache
 }
 
 func (s *Stats) IsZero() bool {
@@ -78,14 +141,20 @@ func (s *Stats) IsZero() bool {
 		s.ObjectsPushed == 0 &&
 		s.CacheHits == 0 &&
 		s.CacheMisses == 0 &&
+		s.LocalCacheHits == 0 &&
+		s.LocalCacheMisses == 0 &&
 		s.CacheErrors == 0 &&
+		s.CacheOnlyRefusals == 0 &&
+		s.CacheCorrupted == 0 &&
+		s.CacheRejected == 0 &&
 		s.CacheAddedDuringPull == 0 &&
 		s.CacheAddedDuringPush == 0 &&
 		s.BytesTransferredFromCache == 0 &&
 		s.BytesTransferredToCache == 0 &&
 		s.BytesTransferredFromRemote == 0 &&
 		s.BytesTransferredToRemote == 0 &&
-		s.Sessions == 0
+		s.Sessions == 0 &&
+		len(s.Targets) == 0
 }
 
 func (s *Stats) Mark() error {
@@ -98,7 +167,20 @@ func (s *Stats) Save() error {
 	if err != nil {
 		return err
 	}
+	return s.save(cacheStoreDir)
+}
+
+// SaveIn saves the statistics for the repository with the given LFS storage
+// directory, instead of the repository of the working directory.
+func (s *Stats) SaveIn(storageDir string) error {
+	cacheStoreDir := StoreDirectory(storageDir)
+	if err := os.MkdirAll(cacheStoreDir, 0755); err != nil {
+		return err
+	}
+	return s.save(cacheStoreDir)
+}
 
+func (s *Stats) save(cacheStoreDir string) error {
 	if s.name == "" {
 		err := s.generateName("stats")
 		if err != nil {
@@ -93,5 +93,11 @@ func cacheStoreDirectory() (string, error) {
 	if !config.InRepo() {
 		return "", fmt.Errorf("not in a git repository")
 	}
-	return fmt.Sprintf("%s/%s", config.LFSStorageDir(), "cache_stats"), nil
+	return StoreDirectory(config.LFSStorageDir()), nil
+}
+
+// StoreDirectory returns the directory the statistics of the repository with
+// the given LFS storage directory are stored in.
+func StoreDirectory(storageDir string) string {
+	return fmt.Sprintf("%s/%s", storageDir, "cache_stats")
 }